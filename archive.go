@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -14,57 +17,256 @@ type Archive struct {
 	MountPoint string
 	// The destination for copying the upperdir folder to
 	ArchiveTo string
-	// The empty file to create for indicating archive is done successfully
+	// The file to create for indicating archive is done successfully
 	ArchiveSuccess string
+	// The format of the success file, an empty file or a json manifest of the archive
+	SuccessFormat string
 	// Archive method
 	Method string
 	// The user (uid) to set for the files inside the tar archive
 	TarUser int
 	// The group (gid) to set for the files inside the tar archive
 	TarGroup int
+	// The user name to look up TarUser from in the container rootfs, empty if the uid is given
+	TarUserName string
+	// The group name to look up TarGroup from in the container rootfs, empty if the gid is given
+	TarGroupName string
+	// The compression level for compressed archive methods, zero means the default level
+	CompressionLevel int
+	// The xattr namespaces to include in the tar archive, all of them are included if it's empty
+	XattrInclude []string
+	// The xattr namespaces to exclude from the tar archive
+	XattrExclude []string
+	// The glob patterns relative to the mount point of paths to archive, everything is archived if it's empty
+	Include []string
+	// The glob patterns relative to the mount point of paths not to archive
+	Exclude []string
+	// The max total size in bytes of the files to archive, zero means no limit
+	MaxSize int64
+	// The max number of files to archive, zero means no limit
+	MaxFiles int64
+	// The user (uid) to chown the archive outputs to, nil means keeping it unchanged
+	OutputUser *int
+	// The group (gid) to chown the archive outputs to, nil means keeping it unchanged
+	OutputGroup *int
+	// The permission bits to set for the archive file or folder and the success file, zero means keeping the default
+	OutputMode os.FileMode
+	// How the host uids and gids of the files are mapped in the archive, empty means keeping them as they are
+	IDMapping string
 }
 
 const (
-	ArchiveMethodCopy    string = "copy"
-	ArchiveMethodTarGzip        = "tar.gz"
+	ArchiveMethodCopy     string = "copy"
+	ArchiveMethodReflink         = "reflink"
+	ArchiveMethodAuto            = "auto"
+	ArchiveMethodMove            = "move"
+	ArchiveMethodTarGzip         = "tar.gz"
+	ArchiveMethodTarZstd         = "tar.zst"
+	ArchiveMethodOCILayer        = "oci-layer"
+	ArchiveMethodOCIImage        = "oci-image"
 )
 
 const (
-	annotationPrefix             string = "com.launchplatform.oci-hooks.archive-overlay."
-	annotationMountPointArg      string = "mount-point"
-	annotationArchiveToArg       string = "archive-to"
-	annotationMethodArg          string = "method"
-	annotationSuccessArg         string = "success"
-	annotationTarContentOwnerArg string = "tar-content-owner"
+	ArchiveStatusSucceeded     string = "succeeded"
+	ArchiveStatusFailed               = "failed"
+	ArchiveStatusQuotaExceeded        = "quota-exceeded"
 )
 
-func parseOwner(owner string) (int, int, error) {
+// ArchiveResult is the result of archiving an upperdir for an archive
+type ArchiveResult struct {
+	// The name of archive
+	Name string
+	// The "destination" filed of overlay mount point to get upperdir folder from
+	MountPoint string
+	// The upperdir folder found for the mount point
+	UpperDir string `json:",omitempty"`
+	// The archive method used
+	Method string
+	// The destination for copying the upperdir folder to
+	ArchiveTo string
+	// The status of the archive
+	Status string
+	// The error message of the archive if it failed
+	Error string `json:",omitempty"`
+}
+
+func newArchiveResult(archive Archive) ArchiveResult {
+	method := archive.Method
+	if method == "" {
+		method = ArchiveMethodCopy
+	}
+	return ArchiveResult{
+		Name:       archive.Name,
+		MountPoint: archive.MountPoint,
+		Method:     method,
+		ArchiveTo:  archive.ArchiveTo,
+	}
+}
+
+// failed returns the result marked as failed with the given error
+func (r ArchiveResult) failed(err error) ArchiveResult {
+	r.Status = ArchiveStatusFailed
+	if errors.Is(err, ErrQuotaExceeded) {
+		r.Status = ArchiveStatusQuotaExceeded
+	}
+	r.Error = err.Error()
+	return r
+}
+
+const (
+	gzipMinCompressionLevel = 1
+	gzipMaxCompressionLevel = 9
+	zstdMinCompressionLevel = 1
+	zstdMaxCompressionLevel = 22
+)
+
+// The compression level ranges of the compressed archive methods
+var compressionLevelRanges = map[string][2]int{
+	ArchiveMethodTarGzip:  {gzipMinCompressionLevel, gzipMaxCompressionLevel},
+	ArchiveMethodOCILayer: {gzipMinCompressionLevel, gzipMaxCompressionLevel},
+	ArchiveMethodTarZstd:  {zstdMinCompressionLevel, zstdMaxCompressionLevel},
+}
+
+const (
+	annotationPrefix              string = "com.launchplatform.oci-hooks.archive-overlay."
+	annotationMountPointArg       string = "mount-point"
+	annotationArchiveToArg        string = "archive-to"
+	annotationMethodArg           string = "method"
+	annotationSuccessArg          string = "success"
+	annotationSuccessFormatArg    string = "success-format"
+	annotationTarContentOwnerArg  string = "tar-content-owner"
+	annotationCompressionLevelArg string = "compression-level"
+	annotationXattrIncludeArg     string = "xattr-include"
+	annotationXattrExcludeArg     string = "xattr-exclude"
+	annotationIncludeArg          string = "include"
+	annotationExcludeArg          string = "exclude"
+	annotationMaxSizeArg          string = "max-size"
+	annotationMaxFilesArg         string = "max-files"
+	annotationOutputOwnerArg      string = "output-owner"
+	annotationOutputModeArg       string = "output-mode"
+	annotationIDMappingArg        string = "id-mapping"
+)
+
+var archiveMethods = []string{
+	ArchiveMethodCopy,
+	ArchiveMethodReflink,
+	ArchiveMethodAuto,
+	ArchiveMethodMove,
+	ArchiveMethodTarGzip,
+	ArchiveMethodTarZstd,
+	ArchiveMethodOCILayer,
+	ArchiveMethodOCIImage,
+}
+
+func isValidMethod(method string) bool {
+	for _, archiveMethod := range archiveMethods {
+		if method == archiveMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// isFileTreeMethod returns true if the method writes the files of the upperdir into a folder as they are
+func isFileTreeMethod(method string) bool {
+	_, ok := methodCloneModes[method]
+	return method == "" || ok || method == ArchiveMethodMove
+}
+
+func isValidSuccessFormat(format string) bool {
+	for _, successFormat := range successFormats {
+		if format == successFormat {
+			return true
+		}
+	}
+	return false
+}
+
+// The user and group names accepted in owner arguments, it follows the POSIX portable user name rules with the
+// trailing "$" of Samba machine accounts like what shadow-utils allows
+// ref: https://pubs.opengroup.org/onlinepubs/9699919799/basedefs/V1_chap03.html#tag_03_437
+var ownerNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*\$?$`)
+
+// The max length of user and group names, same as the one of useradd
+const maxOwnerNameLength = 32
+
+func parseOwnerName(name string) (string, error) {
+	if len(name) > maxOwnerNameLength || !ownerNamePattern.MatchString(name) {
+		return "", fmt.Errorf("Expected user and group in the owner to be ids or valid names but got %q", name)
+	}
+	return name, nil
+}
+
+func parseOwner(owner string) (ownerSpec, error) {
 	parts := strings.Split(owner, ":")
 	if len(parts) < 1 || len(parts) > 2 {
-		return 0, 0, fmt.Errorf("Expected only one or two parts in the owner but got %d instead", len(parts))
+		return ownerSpec{}, fmt.Errorf("Expected only one or two parts in the owner but got %d instead", len(parts))
+	}
+	for _, part := range parts {
+		if part == "" {
+			return ownerSpec{}, fmt.Errorf("Expected user and group in the owner to be non-empty")
+		}
 	}
+	var result ownerSpec
 	uid, err := strconv.Atoi(parts[0])
 	if err != nil {
-		return 0, 0, err
+		result.User, err = parseOwnerName(parts[0])
+		if err != nil {
+			return ownerSpec{}, err
+		}
+	} else {
+		result.Uid = uid
 	}
 	if len(parts) == 1 {
-		return uid, 0, nil
+		return result, nil
 	}
 	gid, err := strconv.Atoi(parts[1])
 	if err != nil {
-		return 0, 0, err
+		result.Group, err = parseOwnerName(parts[1])
+		if err != nil {
+			return ownerSpec{}, err
+		}
+	} else {
+		result.Gid = gid
+	}
+	return result, nil
+}
+
+// parseList parses a comma separated list, empty items are dropped
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		items = append(items, item)
 	}
-	return uid, gid, nil
+	return items
 }
 
-func parseArchives(annotations map[string]string) map[string]Archive {
+// parseArchives parses archives from the annotations and returns them keyed by the mount points, along with the
+// problems found in the annotations, the invalid values or archives and the ones violating the policy are left out
+func parseArchives(annotations map[string]string, policy Policy) (map[string]Archive, []error) {
+	var errs []error
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
 	archives := map[string]Archive{}
-	for key, value := range annotations {
+	for _, key := range keys {
+		value := annotations[key]
 		if !strings.HasPrefix(key, annotationPrefix) {
 			continue
 		}
 		keySuffix := key[len(annotationPrefix):]
 		parts := strings.Split(keySuffix, ".")
+		if len(parts) != 2 || parts[0] == "" {
+			errs = append(errs, fmt.Errorf("invalid annotation key %s, expected %s<ARCHIVE_NAME>.<ARG>", key, annotationPrefix))
+			continue
+		}
 		name, archiveArg := parts[0], parts[1]
 		archive, ok := archives[name]
 		if !ok {
@@ -77,47 +279,232 @@ func parseArchives(annotations map[string]string) map[string]Archive {
 			archive.ArchiveTo = value
 		case annotationSuccessArg:
 			archive.ArchiveSuccess = value
+		case annotationSuccessFormatArg:
+			if !isValidSuccessFormat(value) {
+				errs = append(errs, fmt.Errorf(
+					"invalid success format argument value %s for archive %s, choose from: %s",
+					value,
+					name,
+					strings.Join(successFormats, ", "),
+				))
+				continue
+			}
+			archive.SuccessFormat = value
 		case annotationMethodArg:
 			archive.Method = value
 		case annotationTarContentOwnerArg:
-			uid, gid, err := parseOwner(value)
+			owner, err := parseOwner(value)
 			if err != nil {
-				log.Warnf("Invalid owner argument for %s with error %s, ignored", name, err)
+				errs = append(errs, fmt.Errorf("invalid owner argument for archive %s with error %w", name, err))
 				continue
 			}
-			if uid < 0 || gid < 0 {
-				log.Warnf("Invalid owner argument for %s with negative uid or gid, ignored", name)
+			if owner.Uid < 0 || owner.Gid < 0 {
+				errs = append(errs, fmt.Errorf("invalid owner argument for archive %s with negative uid or gid", name))
 				continue
 			}
-			archive.TarUser = uid
-			archive.TarGroup = gid
+			archive.TarUser = owner.Uid
+			archive.TarGroup = owner.Gid
+			archive.TarUserName = owner.User
+			archive.TarGroupName = owner.Group
+		case annotationCompressionLevelArg:
+			level, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid compression level argument for archive %s with error %w", name, err))
+				continue
+			}
+			archive.CompressionLevel = level
+		case annotationXattrIncludeArg:
+			archive.XattrInclude = parseList(value)
+		case annotationXattrExcludeArg:
+			archive.XattrExclude = parseList(value)
+		case annotationIncludeArg:
+			patterns, err := parsePatterns(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid include argument for archive %s with error %w", name, err))
+				continue
+			}
+			archive.Include = patterns
+		case annotationExcludeArg:
+			patterns, err := parsePatterns(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid exclude argument for archive %s with error %w", name, err))
+				continue
+			}
+			archive.Exclude = patterns
+		case annotationMaxSizeArg:
+			size, err := parseSize(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid max size argument for archive %s with error %w", name, err))
+				continue
+			}
+			archive.MaxSize = size
+		case annotationMaxFilesArg:
+			files, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid max files argument for archive %s with error %w", name, err))
+				continue
+			}
+			if files < 0 {
+				errs = append(errs, fmt.Errorf("invalid max files argument for archive %s with negative value %d", name, files))
+				continue
+			}
+			archive.MaxFiles = files
+		case annotationOutputOwnerArg:
+			owner, err := parseOwner(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid output owner argument for archive %s with error %w", name, err))
+				continue
+			}
+			if owner.User != "" || owner.Group != "" {
+				errs = append(errs, fmt.Errorf("invalid output owner argument for archive %s, only uid and gid are supported", name))
+				continue
+			}
+			if owner.Uid < 0 || owner.Gid < 0 {
+				errs = append(errs, fmt.Errorf("invalid output owner argument for archive %s with negative uid or gid", name))
+				continue
+			}
+			archive.OutputUser = &owner.Uid
+			// Unlike tar-content-owner, the group of the outputs is left unchanged instead of becoming root
+			if strings.Contains(value, ":") {
+				archive.OutputGroup = &owner.Gid
+			}
+		case annotationOutputModeArg:
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid output mode argument for archive %s with error %w", name, err))
+				continue
+			}
+			if mode == 0 || mode > uint64(os.ModePerm) {
+				errs = append(errs, fmt.Errorf("invalid output mode argument %s for archive %s, expected 1 to 0777", value, name))
+				continue
+			}
+			archive.OutputMode = os.FileMode(mode)
+		case annotationIDMappingArg:
+			if !isValidIDMapping(value) {
+				errs = append(errs, fmt.Errorf(
+					"invalid id mapping argument value %s for archive %s, choose from: %s",
+					value,
+					name,
+					strings.Join(idMappings, ", "),
+				))
+				continue
+			}
+			archive.IDMapping = value
 		default:
-			log.Warnf("Invalid archive argument %s for archive %s, ignored", archiveArg, name)
+			errs = append(errs, fmt.Errorf("invalid archive argument %s for archive %s", archiveArg, name))
 			continue
 		}
 		archives[name] = archive
 	}
 
+	names := make([]string, 0, len(archives))
+	for name := range archives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	// Convert map from using name as the key to use mount-point instead
 	mountPointArchives := map[string]Archive{}
-	for _, archive := range archives {
+	mountPointNames := map[string][]string{}
+	for _, name := range names {
+		archive := archives[name]
 		var emptyValue = false
 		if archive.MountPoint == "" {
-			log.Warnf("Empty mount-point archive argument value for archiving %s, ignored", archive.Name)
+			errs = append(errs, fmt.Errorf("empty mount-point argument value for archive %s", archive.Name))
 			emptyValue = true
 		}
 		if archive.ArchiveTo == "" {
-			log.Warnf("Empty archive-to argument value for archive %s, ignored", archive.Name)
+			errs = append(errs, fmt.Errorf("empty archive-to argument value for archive %s", archive.Name))
+			emptyValue = true
+		}
+		if archive.Method != "" && !isValidMethod(archive.Method) {
+			errs = append(errs, fmt.Errorf(
+				"invalid method argument value %s for archive %s, choose from: %s",
+				archive.Method,
+				archive.Name,
+				strings.Join(archiveMethods, ", "),
+			))
+			emptyValue = true
+		}
+		if err := policy.CheckMethod(archive.Method); err != nil {
+			errs = append(errs, fmt.Errorf("archive %s is refused by the policy with error %w", archive.Name, err))
 			emptyValue = true
 		}
-		if archive.Method != "" && archive.Method != ArchiveMethodCopy && archive.Method != ArchiveMethodTarGzip {
-			log.Warnf("Invalid method argument value %s for archive %s, ignored", archive.Method, archive.Name)
+		if archive.OutputUser != nil {
+			if err := policy.CheckOutputOwner(*archive.OutputUser, idOrUnchanged(archive.OutputGroup)); err != nil {
+				errs = append(errs, fmt.Errorf("archive %s is refused by the policy with error %w", archive.Name, err))
+				emptyValue = true
+			}
+		}
+		if archive.OutputMode != 0 {
+			if err := policy.CheckOutputMode(archive.OutputMode); err != nil {
+				errs = append(errs, fmt.Errorf("archive %s is refused by the policy with error %w", archive.Name, err))
+				emptyValue = true
+			}
+		}
+		if archive.OutputUser != nil && archive.IDMapping == IDMappingContainer && isFileTreeMethod(archive.Method) {
+			errs = append(errs, fmt.Errorf(
+				"output-owner cannot be used with id-mapping %s for archive %s, it would override the container ids of the archived files",
+				IDMappingContainer,
+				archive.Name,
+			))
 			emptyValue = true
 		}
+		for _, destPath := range []string{archive.ArchiveTo, archive.ArchiveSuccess} {
+			if destPath == "" {
+				continue
+			}
+			if err := policy.CheckPath(destPath); err != nil {
+				errs = append(errs, fmt.Errorf("archive %s is refused by the policy with error %w", archive.Name, err))
+				emptyValue = true
+			}
+		}
+		if archive.Method == ArchiveMethodMove {
+			if !isAutoRemove(annotations) {
+				errs = append(errs, fmt.Errorf(
+					"method move is refused for archive %s, the container is not marked for removal with %s annotation",
+					archive.Name,
+					podmanAutoRemoveAnnotation,
+				))
+				emptyValue = true
+			}
+			if len(archive.Include) > 0 || len(archive.Exclude) > 0 {
+				errs = append(errs, fmt.Errorf("include and exclude are not supported by method move for archive %s", archive.Name))
+				emptyValue = true
+			}
+		}
+		if archive.CompressionLevel != 0 {
+			levelRange, ok := compressionLevelRanges[archive.Method]
+			if !ok {
+				errs = append(errs, fmt.Errorf("compression level is not supported by method %s for archive %s", archive.Method, archive.Name))
+				archive.CompressionLevel = 0
+			} else if archive.CompressionLevel < levelRange[0] || archive.CompressionLevel > levelRange[1] {
+				errs = append(errs, fmt.Errorf(
+					"invalid compression level %d for archive %s, expected %d to %d",
+					archive.CompressionLevel,
+					archive.Name,
+					levelRange[0],
+					levelRange[1],
+				))
+				archive.CompressionLevel = 0
+			}
+		}
 		if emptyValue {
 			continue
 		}
+		mountPointNames[archive.MountPoint] = append(mountPointNames[archive.MountPoint], archive.Name)
 		mountPointArchives[archive.MountPoint] = archive
 	}
-	return mountPointArchives
+
+	// Archives sharing the same mount point are ambiguous, leave all of them out
+	for _, name := range names {
+		mountPoint := archives[name].MountPoint
+		duplicateNames := mountPointNames[mountPoint]
+		if len(duplicateNames) < 2 || duplicateNames[0] != name {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("duplicate mount point %s for archives %s", mountPoint, strings.Join(duplicateNames, ", ")))
+		delete(mountPointArchives, mountPoint)
+	}
+	return mountPointArchives, errs
 }
@@ -11,6 +11,7 @@ func Test_parseArchives(t *testing.T) {
 	type args struct {
 		annotations map[string]string
 	}
+	outputUser, outputGroup := 2000, 3000
 	tests := []struct {
 		name string
 		args args
@@ -80,6 +81,273 @@ func Test_parseArchives(t *testing.T) {
 			},
 		},
 		},
+		{
+			"tar-content-owner-names", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":       "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":        "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.method":            "tar.gz",
+			"com.launchplatform.oci-hooks.archive-overlay.data.tar-content-owner": "app:app",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:         "data",
+				MountPoint:   "/path/to/mount-point",
+				ArchiveTo:    "/path/to/archive-to",
+				Method:       "tar.gz",
+				TarUser:      0,
+				TarGroup:     0,
+				TarUserName:  "app",
+				TarGroupName: "app",
+			},
+		},
+		},
+		{
+			"compression-level", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":       "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":        "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.method":            "tar.zst",
+			"com.launchplatform.oci-hooks.archive-overlay.data.compression-level": "19",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:             "data",
+				MountPoint:       "/path/to/mount-point",
+				ArchiveTo:        "/path/to/archive-to",
+				Method:           "tar.zst",
+				TarUser:          -1,
+				TarGroup:         -1,
+				CompressionLevel: 19,
+			},
+		},
+		},
+		{
+			"invalid-compression-level", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":       "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":        "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.method":            "tar.zst",
+			"com.launchplatform.oci-hooks.archive-overlay.data.compression-level": "99",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:       "data",
+				MountPoint: "/path/to/mount-point",
+				ArchiveTo:  "/path/to/archive-to",
+				Method:     "tar.zst",
+				TarUser:    -1,
+				TarGroup:   -1,
+			},
+		},
+		},
+		{
+			"gzip-compression-level", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":       "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":        "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.method":            "tar.gz",
+			"com.launchplatform.oci-hooks.archive-overlay.data.compression-level": "9",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:             "data",
+				MountPoint:       "/path/to/mount-point",
+				ArchiveTo:        "/path/to/archive-to",
+				Method:           "tar.gz",
+				TarUser:          -1,
+				TarGroup:         -1,
+				CompressionLevel: 9,
+			},
+		},
+		},
+		{
+			"invalid-gzip-compression-level", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":       "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":        "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.method":            "tar.gz",
+			"com.launchplatform.oci-hooks.archive-overlay.data.compression-level": "19",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:       "data",
+				MountPoint: "/path/to/mount-point",
+				ArchiveTo:  "/path/to/archive-to",
+				Method:     "tar.gz",
+				TarUser:    -1,
+				TarGroup:   -1,
+			},
+		},
+		},
+		{
+			"unsupported-compression-level", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":       "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":        "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.compression-level": "3",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:       "data",
+				MountPoint: "/path/to/mount-point",
+				ArchiveTo:  "/path/to/archive-to",
+				TarUser:    -1,
+				TarGroup:   -1,
+			},
+		},
+		},
+		{
+			"xattr", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":   "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":    "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.method":        "tar.gz",
+			"com.launchplatform.oci-hooks.archive-overlay.data.xattr-include": "security,user",
+			"com.launchplatform.oci-hooks.archive-overlay.data.xattr-exclude": " user.comment, ",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:         "data",
+				MountPoint:   "/path/to/mount-point",
+				ArchiveTo:    "/path/to/archive-to",
+				Method:       "tar.gz",
+				TarUser:      -1,
+				TarGroup:     -1,
+				XattrInclude: []string{"security", "user"},
+				XattrExclude: []string{"user.comment"},
+			},
+		},
+		},
+		{
+			"success-format", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":    "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":     "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.success":        "/path/to/success.json",
+			"com.launchplatform.oci-hooks.archive-overlay.data.success-format": "json",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:           "data",
+				MountPoint:     "/path/to/mount-point",
+				ArchiveTo:      "/path/to/archive-to",
+				ArchiveSuccess: "/path/to/success.json",
+				SuccessFormat:  "json",
+				TarUser:        -1,
+				TarGroup:       -1,
+			},
+		},
+		},
+		{
+			"include-exclude", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.include":     "output/",
+			"com.launchplatform.oci-hooks.archive-overlay.data.exclude":     "*.tmp, __pycache__",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:       "data",
+				MountPoint: "/path/to/mount-point",
+				ArchiveTo:  "/path/to/archive-to",
+				TarUser:    -1,
+				TarGroup:   -1,
+				Include:    []string{"/output"},
+				Exclude:    []string{"*.tmp", "__pycache__"},
+			},
+		},
+		},
+		{
+			"quota", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.max-size":    "10G",
+			"com.launchplatform.oci-hooks.archive-overlay.data.max-files":   "100000",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:       "data",
+				MountPoint: "/path/to/mount-point",
+				ArchiveTo:  "/path/to/archive-to",
+				TarUser:    -1,
+				TarGroup:   -1,
+				MaxSize:    10 * 1024 * 1024 * 1024,
+				MaxFiles:   100000,
+			},
+		},
+		},
+		{
+			"move", args{annotations: map[string]string{
+			"io.podman.annotations.autoremove":                              "TRUE",
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.method":      "move",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:       "data",
+				MountPoint: "/path/to/mount-point",
+				ArchiveTo:  "/path/to/archive-to",
+				Method:     "move",
+				TarUser:    -1,
+				TarGroup:   -1,
+			},
+		},
+		},
+		{
+			"output-owner-mode", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":  "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":   "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.output-owner": "2000:3000",
+			"com.launchplatform.oci-hooks.archive-overlay.data.output-mode":  "0750",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:        "data",
+				MountPoint:  "/path/to/mount-point",
+				ArchiveTo:   "/path/to/archive-to",
+				TarUser:     -1,
+				TarGroup:    -1,
+				OutputUser:  &outputUser,
+				OutputGroup: &outputGroup,
+				OutputMode:  0750,
+			},
+		},
+		},
+		{
+			"output-owner-only-user", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":  "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":   "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.output-owner": "2000",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:       "data",
+				MountPoint: "/path/to/mount-point",
+				ArchiveTo:  "/path/to/archive-to",
+				TarUser:    -1,
+				TarGroup:   -1,
+				OutputUser: &outputUser,
+			},
+		},
+		},
+		{
+			"id-mapping-output-owner-tar", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":  "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":   "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.method":       "tar.gz",
+			"com.launchplatform.oci-hooks.archive-overlay.data.id-mapping":   "container",
+			"com.launchplatform.oci-hooks.archive-overlay.data.output-owner": "2000:3000",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:        "data",
+				MountPoint:  "/path/to/mount-point",
+				ArchiveTo:   "/path/to/archive-to",
+				Method:      "tar.gz",
+				TarUser:     -1,
+				TarGroup:    -1,
+				OutputUser:  &outputUser,
+				OutputGroup: &outputGroup,
+				IDMapping:   "container",
+			},
+		},
+		},
+		{
+			"id-mapping", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+			"com.launchplatform.oci-hooks.archive-overlay.data.id-mapping":  "container",
+		}}, map[string]Archive{
+			"/path/to/mount-point": {
+				Name:       "data",
+				MountPoint: "/path/to/mount-point",
+				ArchiveTo:  "/path/to/archive-to",
+				TarUser:    -1,
+				TarGroup:   -1,
+				IDMapping:  "container",
+			},
+		},
+		},
 		{
 			"multiple", args{annotations: map[string]string{
 			"com.launchplatform.oci-hooks.archive-overlay.data0.mount-point": "/path/to/mount-point0",
@@ -142,13 +410,172 @@ func Test_parseArchives(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := parseArchives(tt.args.annotations); !reflect.DeepEqual(got, tt.want) {
+			if got, _ := parseArchives(tt.args.annotations, Policy{}); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("parseArchives() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func Test_parseArchivesErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErrs    int
+	}{
+		{
+			"valid", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+			}, 0,
+		},
+		{
+			"missing-pair", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+			}, 1,
+		},
+		{
+			"unknown-arg", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.invalid":     "others",
+			}, 1,
+		},
+		{
+			"malformed-key", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data":                   "others",
+				"com.launchplatform.oci-hooks.archive-overlay.data.nested.mount-point": "/path/to/mount-point",
+			}, 2,
+		},
+		{
+			"bad-owner", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":       "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":        "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.tar-content-owner": "1:2:3",
+			}, 1,
+		},
+		{
+			"bad-owner-name", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":       "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":        "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.tar-content-owner": "app:-x",
+			}, 1,
+		},
+		{
+			"bad-success-format", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":    "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":     "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.success-format": "yaml",
+			}, 1,
+		},
+		{
+			"bad-pattern", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.exclude":     "[",
+			}, 1,
+		},
+		{
+			"bad-quota", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.max-size":    "10X",
+				"com.launchplatform.oci-hooks.archive-overlay.data.max-files":   "-1",
+			}, 2,
+		},
+		{
+			"move-without-autoremove", map[string]string{
+				"io.podman.annotations.autoremove":                              "FALSE",
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.method":      "move",
+			}, 1,
+		},
+		{
+			"move-with-filter", map[string]string{
+				"io.podman.annotations.autoremove":                              "TRUE",
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.method":      "move",
+				"com.launchplatform.oci-hooks.archive-overlay.data.exclude":     "*.tmp",
+			}, 1,
+		},
+		{
+			"bad-output-owner", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":  "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":   "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.output-owner": "-1:3000",
+			}, 1,
+		},
+		{
+			"output-owner-names", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":  "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":   "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.output-owner": "app:app",
+			}, 1,
+		},
+		{
+			"id-mapping-output-owner-copy", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":  "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":   "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.id-mapping":   "container",
+				"com.launchplatform.oci-hooks.archive-overlay.data.output-owner": "2000:3000",
+			}, 1,
+		},
+		{
+			"bad-output-mode", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data0.mount-point": "/path/to/mount-point0",
+				"com.launchplatform.oci-hooks.archive-overlay.data0.archive-to":  "/path/to/archive-to0",
+				"com.launchplatform.oci-hooks.archive-overlay.data0.output-mode": "0999",
+				"com.launchplatform.oci-hooks.archive-overlay.data1.mount-point": "/path/to/mount-point1",
+				"com.launchplatform.oci-hooks.archive-overlay.data1.archive-to":  "/path/to/archive-to1",
+				"com.launchplatform.oci-hooks.archive-overlay.data1.output-mode": "4755",
+			}, 2,
+		},
+		{
+			"bad-id-mapping", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.id-mapping":  "host",
+			}, 1,
+		},
+		{
+			"bad-method", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+				"com.launchplatform.oci-hooks.archive-overlay.data.method":      "tar.xz",
+			}, 1,
+		},
+		{
+			"duplicate-mount-point", map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data0.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data0.archive-to":  "/path/to/archive-to0",
+				"com.launchplatform.oci-hooks.archive-overlay.data1.mount-point": "/path/to/mount-point",
+				"com.launchplatform.oci-hooks.archive-overlay.data1.archive-to":  "/path/to/archive-to1",
+			}, 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := parseArchives(tt.annotations, Policy{})
+			assert.Lenf(t, errs, tt.wantErrs, "parseArchives() errors = %v", errs)
+		})
+	}
+}
+
+func Test_parseArchivesDuplicateMountPoint(t *testing.T) {
+	archives, _ := parseArchives(map[string]string{
+		"com.launchplatform.oci-hooks.archive-overlay.data0.mount-point": "/path/to/mount-point",
+		"com.launchplatform.oci-hooks.archive-overlay.data0.archive-to":  "/path/to/archive-to0",
+		"com.launchplatform.oci-hooks.archive-overlay.data1.mount-point": "/path/to/mount-point",
+		"com.launchplatform.oci-hooks.archive-overlay.data1.archive-to":  "/path/to/archive-to1",
+		"com.launchplatform.oci-hooks.archive-overlay.data2.mount-point": "/path/to/other-mount-point",
+		"com.launchplatform.oci-hooks.archive-overlay.data2.archive-to":  "/path/to/archive-to2",
+	}, Policy{})
+	assert.NotContains(t, archives, "/path/to/mount-point")
+	assert.Contains(t, archives, "/path/to/other-mount-point")
+}
+
 func Test_parseOwner(t *testing.T) {
 	type args struct {
 		owner string
@@ -156,37 +583,56 @@ func Test_parseOwner(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		uid     int
-		gid     int
+		want    ownerSpec
 		wantErr assert.ErrorAssertionFunc
 	}{
 		{
-			"only-user", args{"2000"}, 2000, 0, assert.NoError,
+			"only-user", args{"2000"}, ownerSpec{Uid: 2000}, assert.NoError,
+		},
+		{
+			"both", args{"2000:3000"}, ownerSpec{Uid: 2000, Gid: 3000}, assert.NoError,
+		},
+		{
+			"empty", args{""}, ownerSpec{}, assert.Error,
+		},
+		{
+			"empty-group", args{"2000:"}, ownerSpec{}, assert.Error,
+		},
+		{
+			"more-than-two-parts", args{"1:2:3"}, ownerSpec{}, assert.Error,
+		},
+		{
+			"non-int-user", args{"user"}, ownerSpec{User: "user"}, assert.NoError,
+		},
+		{
+			"non-int-both", args{"user:group"}, ownerSpec{User: "user", Group: "group"}, assert.NoError,
+		},
+		{
+			"non-int-group", args{"2000:group"}, ownerSpec{Uid: 2000, Group: "group"}, assert.NoError,
 		},
 		{
-			"both", args{"2000:3000"}, 2000, 3000, assert.NoError,
+			"machine-account-user", args{"host$:group"}, ownerSpec{User: "host$", Group: "group"}, assert.NoError,
 		},
 		{
-			"empty", args{""}, 0, 0, assert.Error,
+			"bad-user-name", args{"user name"}, ownerSpec{}, assert.Error,
 		},
 		{
-			"more-than-two-parts", args{"1:2:3"}, 0, 0, assert.Error,
+			"bad-group-name", args{"2000:-group"}, ownerSpec{}, assert.Error,
 		},
 		{
-			"non-int-user", args{"user"}, 0, 0, assert.Error,
+			"path-group-name", args{"user:../group"}, ownerSpec{}, assert.Error,
 		},
 		{
-			"non-int-both", args{"user:group"}, 0, 0, assert.Error,
+			"too-long-user-name", args{"a-user-name-longer-than-32-chars-x"}, ownerSpec{}, assert.Error,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, got1, err := parseOwner(tt.args.owner)
+			got, err := parseOwner(tt.args.owner)
 			if !tt.wantErr(t, err, fmt.Sprintf("parseOwner(%v)", tt.args.owner)) {
 				return
 			}
-			assert.Equalf(t, tt.uid, got, "parseOwner(%v)", tt.args.owner)
-			assert.Equalf(t, tt.gid, got1, "parseOwner(%v)", tt.args.owner)
+			assert.Equalf(t, tt.want, got, "parseOwner(%v)", tt.args.owner)
 		})
 	}
 }
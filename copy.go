@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// cloneMode is how regular files are copied
+type cloneMode int
+
+const (
+	// Copy the bytes of files
+	cloneModeNever cloneMode = iota
+	// Clone files with reflink, fail if the filesystem doesn't support it
+	cloneModeAlways
+	// Try to clone files with reflink, fall back to copying the bytes per file
+	cloneModeAuto
+)
+
+// The clone modes of copy based archive methods
+var methodCloneModes = map[string]cloneMode{
+	ArchiveMethodCopy:    cloneModeNever,
+	ArchiveMethodReflink: cloneModeAlways,
+	ArchiveMethodAuto:    cloneModeAuto,
+}
+
+type copyOptions struct {
+	// The filter of paths to copy
+	Filter pathFilter
+	// The limits of the files copied
+	Quota archiveQuota
+	// How regular files are copied
+	Clone cloneMode
+	// The mapping of the host uids and gids into the container to chown the copies to, nil means keeping the
+	// copies owned by the user running the hook
+	IDMap *idMapping
+	// The logger with the fields of the archive, nil means the standard logger
+	Logger *log.Entry
+}
+
+// logger returns the logger of the options or the standard logger if it's not set
+func (o copyOptions) logger() *log.Entry {
+	return archiveLogger(o.Logger)
+}
+
+// archiveCopyOptions returns the copy options of the given archive with the method and the id mapping
+func archiveCopyOptions(archive Archive, method string, idMap *idMapping) copyOptions {
+	return copyOptions{
+		Filter: archivePathFilter(archive),
+		Quota:  archiveQuotaLimits(archive),
+		Clone:  methodCloneModes[method],
+		IDMap:  idMap,
+		Logger: log.WithField("archive", archive.Name),
+	}
+}
+
+// removeEmptyDirs removes the given folders if they are empty, the nested ones go first so that their parents
+// become empty
+func removeEmptyDirs(dirs []string) error {
+	sorted := append([]string{}, dirs...)
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+	for _, dir := range sorted {
+		err := os.Remove(dir)
+		if err != nil && !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file from src to dest with the given mode, it clones the file with reflink
+// (FICLONE) instead of copying the bytes depending on the clone mode, the holes of sparse files are kept
+func copyFile(src string, dest string, mode os.FileMode, clone cloneMode, logger *log.Entry) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	cloned := false
+	if clone != cloneModeNever {
+		err = unix.IoctlFileClone(int(destFile.Fd()), int(srcFile.Fd()))
+		if err == nil {
+			cloned = true
+		} else if clone == cloneModeAlways {
+			return fmt.Errorf("failed to clone %s with error %w", src, err)
+		} else {
+			logger.Tracef("Cannot clone %s with error %s, copy it instead", src, err)
+		}
+	}
+	if !cloned {
+		srcInfo, err := srcFile.Stat()
+		if err != nil {
+			return err
+		}
+		if isSparseFile(srcInfo) {
+			// Only the data is copied so that the holes stay holes
+			segments, err := findDataSegments(srcFile, srcInfo.Size())
+			if err != nil {
+				return err
+			}
+			err = copySegments(destFile, srcFile, segments, srcInfo.Size())
+			if err != nil {
+				return err
+			}
+		} else {
+			_, err = io.Copy(destFile, srcFile)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Chmod after writing, so that the mode is not affected by umask and read-only files can be written
+	err = destFile.Chmod(mode)
+	if err != nil {
+		return err
+	}
+	return destFile.Close()
+}
+
+// copyTree copies the content of src folder into the existing dest folder, regular files, folders, symlinks and
+// FIFOs are copied, the other special files such as overlayfs whiteout devices are skipped. The copies are chowned
+// to the container ids of the files if there's an id mapping.
+func copyTree(src string, dest string, options copyOptions) error {
+	counter := &quotaCounter{Quota: options.Quota}
+	var traverseDirs []string
+	dirModes := map[string]os.FileMode{}
+	err := filepath.Walk(src, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		action := options.Filter.Match(relPath, fileInfo.IsDir())
+		if action == filterExclude {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		mode := fileInfo.Mode()
+		var size int64
+		if mode.IsRegular() {
+			size = fileInfo.Size()
+		}
+		if err := counter.Add(size); err != nil {
+			return err
+		}
+		destPath := filepath.Join(dest, relPath)
+		switch {
+		case mode.IsDir():
+			if relPath != "." {
+				err = os.Mkdir(destPath, 0700)
+			}
+			if action == filterTraverse {
+				traverseDirs = append(traverseDirs, destPath)
+			}
+			// Folders are made writable until everything in them is copied
+			dirModes[destPath] = mode
+		case mode.IsRegular():
+			err = copyFile(path, destPath, mode, options.Clone, options.logger())
+		case mode&os.ModeSymlink != 0:
+			var target string
+			target, err = os.Readlink(path)
+			if err == nil {
+				err = os.Symlink(target, destPath)
+			}
+		case mode&os.ModeNamedPipe != 0:
+			err = unix.Mkfifo(destPath, uint32(mode.Perm()))
+			if err == nil {
+				err = os.Chmod(destPath, mode)
+			}
+		default:
+			options.logger().Debugf("Skip copying special file %s with mode %s", path, mode)
+			return nil
+		}
+		if err != nil || options.IDMap == nil {
+			return err
+		}
+		err = options.IDMap.chownToContainer(destPath, fileInfo)
+		if err != nil {
+			return err
+		}
+		if mode.IsRegular() && mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			// Chown clears the setuid and setgid bits
+			return os.Chmod(destPath, mode)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = removeEmptyDirs(traverseDirs)
+	if err != nil {
+		return err
+	}
+	dirs := make([]string, 0, len(dirModes))
+	for dir := range dirModes {
+		dirs = append(dirs, dir)
+	}
+	// The nested ones go first in case the parents are not searchable anymore once their modes are set
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		err = os.Chmod(dir, dirModes[dir])
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
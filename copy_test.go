@@ -0,0 +1,227 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// The tree of files with different modes and empty folders to copy
+var mockCopyTree = map[string]string{
+	"file.txt":               "MOCK_CONTENT",
+	"bin/run.sh":             "#!/bin/sh",
+	"secret/key":             "KEY",
+	"empty/":                 "",
+	"nested/empty/":          "",
+	"nested/deep/file.txt":   "DEEP",
+	"nested/deep/other.conf": "OTHER",
+}
+
+// snapshotTree returns the mode, the symlink target or the content of every path in the given folder
+func snapshotTree(t *testing.T, root string) map[string]string {
+	snapshot := map[string]string{}
+	err := filepath.Walk(root, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		value := fileInfo.Mode().String()
+		if fileInfo.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			value += " -> " + target
+		} else if fileInfo.Mode().IsRegular() {
+			content, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			value += " " + string(content)
+		}
+		snapshot[relPath] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func Test_copyTree(t *testing.T) {
+	srcDir := t.TempDir()
+	destDir := t.TempDir()
+	nestedDir := path.Join(srcDir, "nested")
+	err := os.Mkdir(nestedDir, 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(nestedDir, "file.txt"), []byte("MOCK_CONTENT"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(nestedDir, "readonly.txt"), []byte("READONLY"), 0400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("file.txt", path.Join(nestedDir, "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unix.Mkfifo(path.Join(nestedDir, "fifo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A read-only folder still gets everything in it copied
+	err = os.Chmod(nestedDir, 0550)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(nestedDir, 0750)
+
+	err = copyTree(srcDir, destDir, copyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	destNestedDir := path.Join(destDir, "nested")
+	defer os.Chmod(destNestedDir, 0750)
+	content, err := os.ReadFile(path.Join(destNestedDir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "MOCK_CONTENT")
+	for name, mode := range map[string]fs.FileMode{
+		"nested":              fs.ModeDir | 0550,
+		"nested/file.txt":     0640,
+		"nested/readonly.txt": 0400,
+		"nested/fifo":         fs.ModeNamedPipe | 0600,
+	} {
+		fileInfo, err := os.Lstat(path.Join(destDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, fileInfo.Mode(), mode, name)
+	}
+	target, err := os.Readlink(path.Join(destNestedDir, "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, target, "file.txt")
+}
+
+func Test_copyTreeSkipWhiteouts(t *testing.T) {
+	srcDir := t.TempDir()
+	destDir := t.TempDir()
+	err := unix.Mknod(path.Join(srcDir, "deleted.txt"), unix.S_IFCHR, 0)
+	if err != nil {
+		t.Skipf("Cannot create whiteout device with error %s", err)
+	}
+	err = copyTree(srcDir, destDir, copyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Lstat(path.Join(destDir, "deleted.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_copyFileClone(t *testing.T) {
+	srcDir := t.TempDir()
+	srcFile := path.Join(srcDir, "file.txt")
+	err := os.WriteFile(srcFile, []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Auto mode falls back to copying the bytes if the filesystem doesn't support reflink
+	autoFile := path.Join(srcDir, "auto.txt")
+	err = copyFile(srcFile, autoFile, 0644, cloneModeAuto, archiveLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(autoFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "MOCK_CONTENT")
+
+	reflinkFile := path.Join(srcDir, "reflink.txt")
+	err = copyFile(srcFile, reflinkFile, 0644, cloneModeAlways, archiveLogger(nil))
+	if err != nil {
+		t.Skipf("Cannot clone file with error %s", err)
+	}
+	content, err = os.ReadFile(reflinkFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "MOCK_CONTENT")
+}
+
+func Test_copyTreeModesAndSymlinks(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockCopyTree)
+	// Every mode is set explicitly, so that the result doesn't depend on the umask
+	for name, mode := range map[string]fs.FileMode{
+		".":                      fs.ModeDir | 0755,
+		"file.txt":               0644,
+		"bin":                    fs.ModeDir | 0755,
+		"bin/run.sh":             fs.ModeSetuid | 0755,
+		"secret":                 fs.ModeDir | 0700,
+		"secret/key":             0600,
+		"empty":                  fs.ModeDir | 0711,
+		"nested":                 fs.ModeDir | 0755,
+		"nested/empty":           fs.ModeDir | 0755,
+		"nested/deep":            fs.ModeDir | 0750,
+		"nested/deep/file.txt":   0444,
+		"nested/deep/other.conf": 0640,
+	} {
+		err := os.Chmod(path.Join(srcDir, name), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"link.txt":             "file.txt",
+		"nested/deep/up.txt":   "../../file.txt",
+		"nested/absolute":      "/etc/passwd",
+		"nested/dangling":      "missing.txt",
+		"nested/deep/link-dir": "..",
+	} {
+		err := os.Symlink(target, path.Join(srcDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	destDir := t.TempDir()
+	err := copyTree(srcDir, destDir, copyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The symlinks are copied as they are without following them, and the empty folders are kept
+	assert.Equal(t, snapshotTree(t, destDir), map[string]string{
+		".":                      "drwxr-xr-x",
+		"file.txt":               "-rw-r--r-- MOCK_CONTENT",
+		"link.txt":               "Lrwxrwxrwx -> file.txt",
+		"bin":                    "drwxr-xr-x",
+		"bin/run.sh":             "urwxr-xr-x #!/bin/sh",
+		"secret":                 "drwx------",
+		"secret/key":             "-rw------- KEY",
+		"empty":                  "drwx--x--x",
+		"nested":                 "drwxr-xr-x",
+		"nested/empty":           "drwxr-xr-x",
+		"nested/absolute":        "Lrwxrwxrwx -> /etc/passwd",
+		"nested/dangling":        "Lrwxrwxrwx -> missing.txt",
+		"nested/deep":            "drwxr-x---",
+		"nested/deep/file.txt":   "-r--r--r-- DEEP",
+		"nested/deep/other.conf": "-rw-r----- OTHER",
+		"nested/deep/up.txt":     "Lrwxrwxrwx -> ../../file.txt",
+		"nested/deep/link-dir":   "Lrwxrwxrwx -> ..",
+	})
+}
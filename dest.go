@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The max number of attempts to pick an unused temp name
+const maxTempNameAttempts = 10000
+
+// procFdPath returns the path to the name in the opened folder through /proc/self/fd, so that the path to the
+// folder is not resolved again
+func procFdPath(dir *os.File, name string) string {
+	return filepath.Join(fmt.Sprintf("/proc/self/fd/%d", dir.Fd()), name)
+}
+
+// openatNoFollow opens the single path component in the folder without following it if it's a symlink, it's the
+// fallback for kernels without openat2
+func openatNoFollow(dirFd int, name string, flags int, mode uint32) (int, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return -1, fmt.Errorf("invalid path component %q", name)
+	}
+	fd, err := unix.Openat(dirFd, name, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+	if errors.Is(err, unix.ENOTDIR) {
+		// A symlink opened with O_DIRECTORY fails with ENOTDIR instead of ELOOP
+		var stat unix.Stat_t
+		if unix.Fstatat(dirFd, name, &stat, unix.AT_SYMLINK_NOFOLLOW) == nil && stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return -1, unix.ELOOP
+		}
+	}
+	return fd, err
+}
+
+// openBeneath opens the single path component in the folder with openat2, without following any symlink or going
+// out of the folder, the component is opened with O_NOFOLLOW instead if openat2 is not supported
+func openBeneath(dirFd int, name string, flags int, mode uint32) (int, error) {
+	fd, err := unix.Openat2(dirFd, name, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Mode:    uint64(mode),
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_BENEATH,
+	})
+	if errors.Is(err, unix.ENOSYS) {
+		return openatNoFollow(dirFd, name, flags, mode)
+	}
+	return fd, err
+}
+
+// destRoot returns the trusted folder for resolving the given parent folder of a destination beneath it, which is
+// the allowed prefix of the policy the folder is in, or the nearest existing folder otherwise, the host symlinks on
+// the way to it, such as /home to /var/home, are followed as usual
+func destRoot(parentDir string) (string, error) {
+	if prefix, ok := archivePolicy.findAllowedPrefix(parentDir); ok {
+		return prefix, nil
+	}
+	root := parentDir
+	for {
+		_, err := os.Stat(root)
+		if err == nil || root == "/" || !errors.Is(err, os.ErrNotExist) {
+			return root, nil
+		}
+		root = filepath.Dir(root)
+	}
+}
+
+// openDestDir opens the parent folder of the destination path, the folders beneath the trusted root are opened one
+// by one without following symlinks, and created if they don't exist when create is true
+func openDestDir(path string, create bool) (*os.File, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	parentDir := filepath.Dir(path)
+	root, err := destRoot(parentDir)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.OpenFile(root, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open destination root %s with error %w", root, err)
+	}
+	relPath, err := filepath.Rel(root, parentDir)
+	if err != nil {
+		dir.Close()
+		return nil, err
+	}
+	if relPath == "." {
+		return dir, nil
+	}
+	currentPath := root
+	for _, name := range strings.Split(relPath, string(filepath.Separator)) {
+		currentPath = filepath.Join(currentPath, name)
+		if create {
+			err = unix.Mkdirat(int(dir.Fd()), name, 0755)
+			if err != nil && !errors.Is(err, unix.EEXIST) {
+				dir.Close()
+				return nil, fmt.Errorf("failed to create folder %s with error %w", currentPath, err)
+			}
+		}
+		fd, err := openBeneath(int(dir.Fd()), name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		dir.Close()
+		if errors.Is(err, unix.ELOOP) {
+			return nil, fmt.Errorf("refused to follow symlink at %s for destination %s", currentPath, path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open folder %s with error %w", currentPath, err)
+		}
+		dir = os.NewFile(uintptr(fd), currentPath)
+	}
+	return dir, nil
+}
+
+// createBeneath creates a new entry with a random name from the pattern in the folder with the given create function,
+// and returns the name
+func createBeneath(pattern string, create func(name string) error) (string, error) {
+	randomBytes := make([]byte, 6)
+	for i := 0; i < maxTempNameAttempts; i++ {
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return "", err
+		}
+		name := strings.Replace(pattern, "*", hex.EncodeToString(randomBytes), 1)
+		err = create(name)
+		if errors.Is(err, unix.EEXIST) {
+			continue
+		}
+		return name, err
+	}
+	return "", fmt.Errorf("failed to find an unused temp name for %s", pattern)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"testing"
+)
+
+// The files the planted symlinks point to
+var mockVictimTree = map[string]string{"cron": "VICTIM"}
+
+func assertVictimUntouched(t *testing.T, victimDir string) {
+	entries, err := os.ReadDir(victimDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 1)
+	content, err := os.ReadFile(path.Join(victimDir, "cron"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "VICTIM")
+}
+
+func Test_archiveTarGzipSymlinkDestination(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockMoveTree)
+	victimDir := t.TempDir()
+	writeTree(t, victimDir, mockVictimTree)
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	err := os.Symlink(path.Join(victimDir, "cron"), outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = archiveTarGzip(srcDir, outputFile, tarOptions{Uid: -1, Gid: -1}, 0, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The symlink is replaced by the archive instead of being written through
+	fileInfo, err := os.Lstat(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, fileInfo.Mode().IsRegular())
+	assertVictimUntouched(t, victimDir)
+}
+
+func Test_writeFileAtomicSymlinkDestination(t *testing.T) {
+	outputDir := t.TempDir()
+	victimDir := t.TempDir()
+	writeTree(t, victimDir, mockVictimTree)
+	successFile := path.Join(outputDir, "success")
+	err := os.Symlink(path.Join(victimDir, "cron"), successFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeFileAtomic(successFile, []byte("SUCCESS"), 0644, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(successFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "SUCCESS")
+	assertVictimUntouched(t, victimDir)
+}
+
+func Test_archiveDirSymlinkDestination(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockMoveTree)
+	victimDir := t.TempDir()
+	writeTree(t, victimDir, mockVictimTree)
+	archiveTo := path.Join(outputDir, "archive")
+	err := os.Symlink(victimDir, archiveTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = archiveDir(archiveTo, outputOwnership{}, func(stageDir string) (archiveStats, error) {
+		return archiveStats{}, copyTree(srcDir, stageDir, copyOptions{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Lstat(archiveTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, fileInfo.IsDir())
+	assertVictimUntouched(t, victimDir)
+}
+
+func Test_archiveDirSymlinkParent(t *testing.T) {
+	rootDir := t.TempDir()
+	defer func(policy Policy) {
+		archivePolicy = policy
+	}(archivePolicy)
+	archivePolicy = Policy{AllowedPrefixes: []string{rootDir}}
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockMoveTree)
+	victimDir := t.TempDir()
+	writeTree(t, victimDir, mockVictimTree)
+	// The symlink in the allowed root would lead the archive out of it
+	err := os.Symlink(victimDir, path.Join(rootDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, archiveTo := range []string{
+		path.Join(rootDir, "link", "archive"),
+		path.Join(rootDir, "link", "nested", "archive"),
+	} {
+		_, err = archiveDir(archiveTo, outputOwnership{}, func(stageDir string) (archiveStats, error) {
+			return archiveStats{}, copyTree(srcDir, stageDir, copyOptions{})
+		})
+		assert.ErrorContains(t, err, "refused to follow symlink", archiveTo)
+	}
+	outputFile := path.Join(rootDir, "link", "cron")
+	_, err = archiveTarGzip(srcDir, outputFile, tarOptions{Uid: -1, Gid: -1}, 0, outputOwnership{})
+	assert.ErrorContains(t, err, "refused to follow symlink")
+	assertVictimUntouched(t, victimDir)
+
+	// The missing folders are created beneath the root
+	archiveTo := path.Join(rootDir, "nested", "archive")
+	_, err = archiveDir(archiveTo, outputOwnership{}, func(stageDir string) (archiveStats, error) {
+		return archiveStats{}, copyTree(srcDir, stageDir, copyOptions{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path.Join(archiveTo, "nested", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "MOCK_CONTENT")
+}
+
+func Test_archiveDirHostSymlink(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockMoveTree)
+	writeTree(t, outputDir, map[string]string{"var/home/": ""})
+	// Without a policy, the symlinks of the host on the existing part of the path are followed, like /home to
+	// /var/home on Fedora Silverblue
+	err := os.Symlink("var/home", path.Join(outputDir, "home"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiveTo := path.Join(outputDir, "home", "user", "archive")
+	_, err = archiveDir(archiveTo, outputOwnership{}, func(stageDir string) (archiveStats, error) {
+		return archiveStats{}, copyTree(srcDir, stageDir, copyOptions{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeFileAtomic(path.Join(outputDir, "home", "user", "success"), []byte("SUCCESS"), 0644, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path.Join(outputDir, "var", "home", "user", "archive", "nested", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "MOCK_CONTENT")
+	_, err = os.Stat(path.Join(outputDir, "var", "home", "user", "success"))
+	assert.Nil(t, err)
+}
+
+func Test_openatNoFollow(t *testing.T) {
+	rootDir := t.TempDir()
+	victimDir := t.TempDir()
+	writeTree(t, victimDir, mockVictimTree)
+	err := os.Symlink(victimDir, path.Join(rootDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.Open(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	_, err = openatNoFollow(int(dir.Fd()), "link", unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	assert.True(t, errors.Is(err, unix.ELOOP))
+	_, err = openatNoFollow(int(dir.Fd()), "link/cron", unix.O_RDONLY, 0)
+	assert.NotNil(t, err)
+	_, err = openatNoFollow(int(dir.Fd()), "..", unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	UpperDirDiscoveryAuto      string = "auto"
+	UpperDirDiscoveryMountInfo        = "mountinfo"
+	UpperDirDiscoveryProcess          = "process"
+	UpperDirDiscoveryStorage          = "storage"
+)
+
+var UpperDirDiscoveries = []string{
+	UpperDirDiscoveryAuto,
+	UpperDirDiscoveryMountInfo,
+	UpperDirDiscoveryProcess,
+	UpperDirDiscoveryStorage,
+}
+
+// The fs type of fuse-overlayfs mounts in mountinfo
+const fuseOverlayFSType = "fuse.fuse-overlayfs"
+
+// The sibling upperdir names of merged dirs in the layouts containers/storage creates, "merge" is for
+// image mounts and "merged" is for container rootfs in the overlay driver.
+// ref: https://github.com/containers/podman/blob/v4.5.1/pkg/util/utils.go
+// ref: https://github.com/containers/storage/blob/v1.48.0/drivers/overlay/overlay.go
+var layoutUpperDirs = map[string]string{
+	"merge":  "upper",
+	"merged": "diff",
+}
+
+// mountOptionsFinder finds the overlay mount options for the source path of a bind mount
+type mountOptionsFinder interface {
+	FindMountOptions(source string) ([]string, error)
+}
+
+// newMountOptionsFinder creates the mount options finder for the given upperdir discovery strategy
+func newMountOptionsFinder(discovery string) (mountOptionsFinder, error) {
+	switch discovery {
+	case UpperDirDiscoveryAuto:
+		return chainMountOptionsFinder{
+			&mountInfoMountOptionsFinder{path: mountInfoPath},
+			&processMountOptionsFinder{},
+			storageMountOptionsFinder{},
+		}, nil
+	case UpperDirDiscoveryMountInfo:
+		return &mountInfoMountOptionsFinder{path: mountInfoPath}, nil
+	case UpperDirDiscoveryProcess:
+		return &processMountOptionsFinder{}, nil
+	case UpperDirDiscoveryStorage:
+		return storageMountOptionsFinder{}, nil
+	}
+	return nil, fmt.Errorf("unknown upperdir discovery %s, choose from: %s", discovery, strings.Join(UpperDirDiscoveries, ", "))
+}
+
+// lowerDirsMountOptionsFinder finds mount options with lowerdirs for the methods needing them, it may try the slower
+// ways the plain FindMountOptions skips once an upperdir is found
+type lowerDirsMountOptionsFinder interface {
+	FindMountOptionsWithLowerDirs(source string) ([]string, error)
+}
+
+// chainMountOptionsFinder tries the finders in order and returns the first mount options found
+type chainMountOptionsFinder []mountOptionsFinder
+
+func (c chainMountOptionsFinder) FindMountOptions(source string) ([]string, error) {
+	var errs []string
+	for _, finder := range c {
+		mountOptions, err := finder.FindMountOptions(source)
+		if err == nil {
+			return mountOptions, nil
+		}
+		log.Debugf("Cannot find mount options for %s with %T, error %s", source, finder, err)
+		errs = append(errs, err.Error())
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// FindMountOptionsWithLowerDirs tries the finders in order and returns the first mount options found with lowerdirs,
+// the first ones found without lowerdirs are returned if none of the finders finds lowerdirs
+func (c chainMountOptionsFinder) FindMountOptionsWithLowerDirs(source string) ([]string, error) {
+	var errs []string
+	var withoutLowerDirs []string
+	for _, finder := range c {
+		mountOptions, err := finder.FindMountOptions(source)
+		if err != nil {
+			log.Debugf("Cannot find mount options for %s with %T, error %s", source, finder, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		if hasLowerDirs(mountOptions) {
+			return mountOptions, nil
+		}
+		log.Debugf("No lowerdirs found for %s with %T, try the next one", source, finder)
+		if withoutLowerDirs == nil {
+			withoutLowerDirs = mountOptions
+		}
+	}
+	if withoutLowerDirs != nil {
+		return withoutLowerDirs, nil
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// hasLowerDirs returns true if the mount options have the lowerdir option
+func hasLowerDirs(mountOptions []string) bool {
+	for _, option := range mountOptions {
+		if strings.HasPrefix(option, lowerDirPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// processMountOptionsFinder finds mount options from the command line arguments of fuse-overlayfs processes
+type processMountOptionsFinder struct {
+	listed       bool
+	mountOptions map[string][]string
+	err          error
+}
+
+func (f *processMountOptionsFinder) FindMountOptions(source string) ([]string, error) {
+	if !f.listed {
+		f.mountOptions, f.err = listFuseMountOptions()
+		f.listed = true
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	mountOptions, ok := f.mountOptions[source]
+	if !ok {
+		return nil, fmt.Errorf("no fuse mount process found for %s", source)
+	}
+	return mountOptions, nil
+}
+
+type mountInfo struct {
+	// The root of the mount within the filesystem
+	Root string
+	// The mount point relative to the process's root
+	MountPoint string
+	// The filesystem type
+	FSType string
+	// The filesystem specific mount source
+	Source string
+	// The per super block options
+	SuperOptions []string
+}
+
+// unescapeMountInfo unescapes the octal escaped characters (space, tab, newline and backslash) in mountinfo fields
+func unescapeMountInfo(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) {
+			code, err := strconv.ParseUint(value[i+1:i+4], 8, 8)
+			if err == nil {
+				builder.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		builder.WriteByte(value[i])
+	}
+	return builder.String()
+}
+
+// parseMountInfo parses the mountinfo file
+// ref: https://man7.org/linux/man-pages/man5/proc.5.html
+func parseMountInfo(path string) ([]mountInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			// The optional fields start from the 7th field and end with a single hyphen
+			if i >= 6 && field == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 0 || len(fields) < separator+4 {
+			return nil, fmt.Errorf("invalid mountinfo line %q", scanner.Text())
+		}
+		mounts = append(mounts, mountInfo{
+			Root:         unescapeMountInfo(fields[3]),
+			MountPoint:   unescapeMountInfo(fields[4]),
+			FSType:       fields[separator+1],
+			Source:       unescapeMountInfo(fields[separator+2]),
+			SuperOptions: strings.Split(unescapeMountInfo(fields[separator+3]), ","),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// findLayoutUpperDir finds the upperdir next to the given merged dir in the layouts containers/storage creates
+func findLayoutUpperDir(mergedDir string) (string, error) {
+	upperDirName, ok := layoutUpperDirs[filepath.Base(mergedDir)]
+	if !ok {
+		return "", fmt.Errorf("unknown merged dir layout of %s", mergedDir)
+	}
+	upperDir := filepath.Join(filepath.Dir(mergedDir), upperDirName)
+	fileInfo, err := os.Stat(upperDir)
+	if err != nil {
+		return "", err
+	}
+	if !fileInfo.IsDir() {
+		return "", fmt.Errorf("upperdir %s is not a directory", upperDir)
+	}
+	return upperDir, nil
+}
+
+// findLayoutLowerDirs finds the lowerdirs of the given merged dir in the layouts containers/storage creates, only the
+// container rootfs layout has them next to the merged dir, none is returned for the image mount layout
+func findLayoutLowerDirs(mergedDir string) ([]string, error) {
+	if filepath.Base(mergedDir) != "merged" {
+		return nil, nil
+	}
+	layerDir := filepath.Dir(mergedDir)
+	return readStorageLowerDirs(filepath.Dir(layerDir), filepath.Base(layerDir))
+}
+
+// mountInfoMountOptionsFinder finds mount options for the given source from mountinfo, it reads the super options
+// of native overlay mounts, and for fuse-overlayfs mounts, it resolves the upperdir and lowerdirs from the on-disk
+// layout containers/storage creates for the mount
+type mountInfoMountOptionsFinder struct {
+	path   string
+	loaded bool
+	mounts []mountInfo
+	err    error
+}
+
+func (f *mountInfoMountOptionsFinder) FindMountOptions(source string) ([]string, error) {
+	if !f.loaded {
+		f.mounts, f.err = parseMountInfo(f.path)
+		f.loaded = true
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	source = filepath.Clean(source)
+	var found *mountInfo
+	// The last one is the top most mount in case of mounts stacked on the same mount point
+	for i := range f.mounts {
+		if f.mounts[i].MountPoint == source {
+			found = &f.mounts[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no mount found for %s in %s", source, f.path)
+	}
+	if found.Root != "/" {
+		return nil, fmt.Errorf("mount at %s is a bind mount of sub dir %s, not supported", source, found.Root)
+	}
+	switch found.FSType {
+	case "overlay":
+		return found.SuperOptions, nil
+	case fuseOverlayFSType:
+		upperDir, err := findLayoutUpperDir(source)
+		if err != nil {
+			return nil, err
+		}
+		mountOptions := []string{upperDirPrefix + upperDir}
+		lowerDirs, err := findLayoutLowerDirs(source)
+		if err != nil {
+			return nil, err
+		}
+		if len(lowerDirs) > 0 {
+			mountOptions = append(mountOptions, lowerDirPrefix+strings.Join(lowerDirs, ":"))
+		}
+		return mountOptions, nil
+	}
+	return nil, fmt.Errorf("unexpected fs type %s for mount at %s", found.FSType, source)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+type mockMountOptionsFinder struct {
+	mountOptions map[string][]string
+}
+
+func (f mockMountOptionsFinder) FindMountOptions(source string) ([]string, error) {
+	mountOptions, ok := f.mountOptions[source]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return mountOptions, nil
+}
+
+func Test_unescapeMountInfo(t *testing.T) {
+	assert.Equal(t, unescapeMountInfo("/path/to/dir"), "/path/to/dir")
+	assert.Equal(t, unescapeMountInfo(`/path/to/my\040dir`), "/path/to/my dir")
+	assert.Equal(t, unescapeMountInfo(`/path\134to\011dir`), "/path\\to\tdir")
+	assert.Equal(t, unescapeMountInfo(`/path/to\04`), `/path/to\04`)
+}
+
+func Test_mountInfoMountOptionsFinder(t *testing.T) {
+	tempDir := t.TempDir()
+	fuseDir := path.Join(tempDir, "overlay containers", "3190055391")
+	err := os.MkdirAll(path.Join(fuseDir, "upper"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(fuseDir, "merge"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	escapedFuseDir := path.Join(tempDir, `overlay\040containers`, "3190055391")
+	mountInfoContent := fmt.Sprintf(`22 1 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:5 - proc proc rw
+95 22 0:45 / /path/to/merged rw,relatime shared:50 - overlay overlay rw,lowerdir=/path/to/lower,upperdir=/path/to/upper,workdir=/path/to/work
+96 22 0:46 / %s/merge rw,nodev,relatime - fuse.fuse-overlayfs fuse-overlayfs rw,user_id=0,group_id=0
+97 22 0:47 / /path/to/unknown-fuse rw,nodev,relatime - fuse.fuse-overlayfs fuse-overlayfs rw,user_id=0,group_id=0
+98 22 8:1 /sub /path/to/bind rw,relatime shared:1 master:2 - ext4 /dev/sda1 rw
+99 22 8:1 / /path/to/ext4 rw,relatime shared:1 - ext4 /dev/sda1 rw
+`, escapedFuseDir)
+	mountInfoFile := path.Join(tempDir, "mountinfo")
+	err = os.WriteFile(mountInfoFile, []byte(mountInfoContent), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder := &mountInfoMountOptionsFinder{path: mountInfoFile}
+	mountOptions, err := finder.FindMountOptions("/path/to/merged")
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"rw", "lowerdir=/path/to/lower", "upperdir=/path/to/upper", "workdir=/path/to/work"})
+
+	mountOptions, err = finder.FindMountOptions(path.Join(fuseDir, "merge"))
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=" + path.Join(fuseDir, "upper")})
+
+	for _, source := range []string{"/path/to/unknown-fuse", "/path/to/bind", "/path/to/ext4", "/path/to/missing"} {
+		_, err = finder.FindMountOptions(source)
+		assert.Error(t, err, source)
+	}
+}
+
+func Test_chainMountOptionsFinder(t *testing.T) {
+	finder := chainMountOptionsFinder{
+		mockMountOptionsFinder{mountOptions: map[string][]string{"/path/to/first": {"upperdir=/path/to/first-upper"}}},
+		mockMountOptionsFinder{mountOptions: map[string][]string{
+			"/path/to/first":  {"upperdir=/path/to/unused"},
+			"/path/to/second": {"upperdir=/path/to/second-upper"},
+		}},
+	}
+	mountOptions, err := finder.FindMountOptions("/path/to/first")
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=/path/to/first-upper"})
+	mountOptions, err = finder.FindMountOptions("/path/to/second")
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=/path/to/second-upper"})
+	_, err = finder.FindMountOptions("/path/to/missing")
+	assert.Error(t, err)
+
+	// The mount options with lowerdirs found later take precedence only when they are needed
+	finder = chainMountOptionsFinder{
+		mockMountOptionsFinder{mountOptions: map[string][]string{"/path/to/first": {"upperdir=/path/to/first-upper"}}},
+		mockMountOptionsFinder{mountOptions: map[string][]string{}},
+		mockMountOptionsFinder{mountOptions: map[string][]string{
+			"/path/to/first": {"upperdir=/path/to/first-upper", "lowerdir=/path/to/lower"},
+		}},
+	}
+	mountOptions, err = finder.FindMountOptions("/path/to/first")
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=/path/to/first-upper"})
+	mountOptions, err = finder.FindMountOptionsWithLowerDirs("/path/to/first")
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=/path/to/first-upper", "lowerdir=/path/to/lower"})
+	// The ones without lowerdirs are used if no finder finds lowerdirs
+	mountOptions, err = finder[:2].FindMountOptionsWithLowerDirs("/path/to/first")
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=/path/to/first-upper"})
+	_, err = finder.FindMountOptionsWithLowerDirs("/path/to/missing")
+	assert.Error(t, err)
+}
+
+// failingMountOptionsFinder fails the test if it's ever asked, like a process scan that should be skipped
+type failingMountOptionsFinder struct {
+	t *testing.T
+}
+
+func (f failingMountOptionsFinder) FindMountOptions(source string) ([]string, error) {
+	f.t.Errorf("Unexpected mount options lookup for %s", source)
+	return nil, errors.New("unexpected")
+}
+
+func Test_findMountOptionsLowerDirs(t *testing.T) {
+	mount := spec.Mount{Destination: "/data", Source: "/path/to/merge", Type: "bind"}
+	finder := chainMountOptionsFinder{
+		mockMountOptionsFinder{mountOptions: map[string][]string{"/path/to/merge": {"upperdir=/path/to/upper"}}},
+		failingMountOptionsFinder{t: t},
+	}
+	// The methods other than oci-image stop at the first upperdir found
+	mountOptions, err := findMountOptions(mount, finder, false)
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=/path/to/upper"})
+
+	finder[1] = mockMountOptionsFinder{mountOptions: map[string][]string{
+		"/path/to/merge": {"upperdir=/path/to/upper", "lowerdir=/path/to/lower"},
+	}}
+	mountOptions, err = findMountOptions(mount, finder, true)
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=/path/to/upper", "lowerdir=/path/to/lower"})
+}
+
+func Test_mountInfoMountOptionsFinderRootfsLowerDirs(t *testing.T) {
+	overlayDir := t.TempDir()
+	writeTree(t, overlayDir, map[string]string{
+		"layer/diff/":   "",
+		"layer/merged/": "",
+		"layer/lower":   "l/BASE",
+		"base/diff/":    "",
+	})
+	err := os.MkdirAll(path.Join(overlayDir, "l"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("../base/diff", path.Join(overlayDir, "l", "BASE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergedDir := path.Join(overlayDir, "layer", "merged")
+	mountInfoFile := path.Join(t.TempDir(), "mountinfo")
+	writeTree(t, path.Dir(mountInfoFile), map[string]string{
+		"mountinfo": fmt.Sprintf("96 22 0:46 / %s rw,nodev,relatime - fuse.fuse-overlayfs fuse-overlayfs rw\n", mergedDir),
+	})
+	finder := &mountInfoMountOptionsFinder{path: mountInfoFile}
+	mountOptions, err := finder.FindMountOptions(mergedDir)
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{
+		"upperdir=" + path.Join(overlayDir, "layer", "diff"),
+		"lowerdir=" + path.Join(overlayDir, "base", "diff"),
+	})
+}
+
+func Test_newMountOptionsFinder(t *testing.T) {
+	for _, discovery := range UpperDirDiscoveries {
+		_, err := newMountOptionsFinder(discovery)
+		assert.NoError(t, err)
+	}
+	_, err := newMountOptionsFinder("invalid")
+	assert.Error(t, err)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathFilter decides which paths in the upperdir to archive with glob patterns relative to the mount point. A
+// pattern without a slash matches the base name at any depth, otherwise it's anchored at the mount point and matches
+// the whole path. A matched folder has everything in it matched as well.
+type pathFilter struct {
+	// The patterns of paths to include, everything is included if it's empty
+	Include []string
+	// The patterns of paths to exclude, they take precedence over the include patterns
+	Exclude []string
+}
+
+// parsePatterns parses a comma separated list of glob patterns relative to the mount point, the patterns with a
+// slash in them are cleaned into the ones starting with a slash
+func parsePatterns(value string) ([]string, error) {
+	var patterns []string
+	for _, item := range parseList(value) {
+		pattern := item
+		if strings.Contains(item, "/") {
+			pattern = path.Clean("/" + item)
+		}
+		if pattern == "/" {
+			return nil, fmt.Errorf("pattern %s matches the mount point itself", item)
+		}
+		// Report the syntax errors early, the path doesn't matter for that
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s with error %w", item, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// isAnchoredPattern returns true if the pattern matches the whole path instead of the base name
+func isAnchoredPattern(pattern string) bool {
+	return strings.Contains(pattern, "/")
+}
+
+// matchPattern returns true if the pattern matches the given slash separated relative path
+func matchPattern(pattern string, relPath string) bool {
+	if isAnchoredPattern(pattern) {
+		pattern = strings.TrimPrefix(pattern, "/")
+	} else {
+		relPath = path.Base(relPath)
+	}
+	matched, _ := path.Match(pattern, relPath)
+	return matched
+}
+
+// matchPatternPrefix returns true if paths under the given folder could match the pattern
+func matchPatternPrefix(pattern string, dir string) bool {
+	if !isAnchoredPattern(pattern) {
+		return true
+	}
+	patternParts := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	dirParts := strings.Split(dir, "/")
+	if len(dirParts) >= len(patternParts) {
+		return false
+	}
+	for i, dirPart := range dirParts {
+		matched, _ := path.Match(patternParts[i], dirPart)
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny returns true if any of the patterns matches the given path or any of its parent folders
+func matchAny(patterns []string, relPath string) bool {
+	for current := relPath; current != "."; current = path.Dir(current) {
+		for _, pattern := range patterns {
+			if matchPattern(pattern, current) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterAction is what to do with a path in the upperdir
+type filterAction int
+
+const (
+	// The path is archived
+	filterInclude filterAction = iota
+	// The path is left out, along with everything in it for a folder
+	filterExclude
+	// The folder is not included itself but could have included paths in it, it's only archived if anything in it is
+	filterTraverse
+)
+
+// Match returns the action for the given path relative to the upperdir
+func (f pathFilter) Match(relPath string, isDir bool) filterAction {
+	relPath = path.Clean(filepath.ToSlash(relPath))
+	if relPath == "." {
+		return filterInclude
+	}
+	if matchAny(f.Exclude, relPath) {
+		return filterExclude
+	}
+	if len(f.Include) == 0 || matchAny(f.Include, relPath) {
+		return filterInclude
+	}
+	if !isDir {
+		return filterExclude
+	}
+	for _, pattern := range f.Include {
+		if matchPatternPrefix(pattern, relPath) {
+			return filterTraverse
+		}
+	}
+	return filterExclude
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+func Test_parsePatterns(t *testing.T) {
+	patterns, err := parsePatterns("/output/, *.tmp,__pycache__,, ./logs/*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, patterns, []string{"/output", "*.tmp", "__pycache__", "/logs/*.log"})
+
+	_, err = parsePatterns("[")
+	assert.NotNil(t, err)
+	_, err = parsePatterns("/")
+	assert.NotNil(t, err)
+}
+
+func Test_pathFilterMatch(t *testing.T) {
+	filter := pathFilter{
+		Include: []string{"/output", "/logs/*.log"},
+		Exclude: []string{"*.tmp", "__pycache__"},
+	}
+	tests := []struct {
+		relPath string
+		isDir   bool
+		want    filterAction
+	}{
+		{".", true, filterInclude},
+		{"output", true, filterInclude},
+		{"output/result.txt", false, filterInclude},
+		{"output/nested/result.txt", false, filterInclude},
+		{"output/result.tmp", false, filterExclude},
+		{"output/nested/__pycache__", true, filterExclude},
+		{"output/nested/__pycache__/module.pyc", false, filterExclude},
+		{"logs", true, filterTraverse},
+		{"logs/app.log", false, filterInclude},
+		{"logs/app.txt", false, filterExclude},
+		{"logs/nested", true, filterExclude},
+		{"nested/output", true, filterExclude},
+		{"others", true, filterExclude},
+		{"others.txt", false, filterExclude},
+	}
+	for _, tt := range tests {
+		t.Run(tt.relPath, func(t *testing.T) {
+			assert.Equal(t, filter.Match(tt.relPath, tt.isDir), tt.want)
+		})
+	}
+}
+
+func Test_pathFilterMatchBaseNameInclude(t *testing.T) {
+	filter := pathFilter{Include: []string{"output"}}
+	assert.Equal(t, filter.Match("nested", true), filterTraverse)
+	assert.Equal(t, filter.Match("nested/output", true), filterInclude)
+	assert.Equal(t, filter.Match("nested/file.txt", false), filterExclude)
+}
+
+func Test_pathFilterMatchNoInclude(t *testing.T) {
+	filter := pathFilter{Exclude: []string{"/nested/*.tmp"}}
+	assert.Equal(t, filter.Match("nested", true), filterInclude)
+	assert.Equal(t, filter.Match("nested/file.txt", false), filterInclude)
+	assert.Equal(t, filter.Match("nested/file.tmp", false), filterExclude)
+	assert.Equal(t, filter.Match("file.tmp", false), filterInclude)
+}
+
+// The upperdir content the filter tests archive
+var mockFilterTree = map[string]string{
+	"output/result.txt":             "MOCK_CONTENT",
+	"output/result.tmp":             "MOCK_CONTENT",
+	"output/__pycache__/module.pyc": "MOCK_CONTENT",
+	"others/file.txt":               "MOCK_CONTENT",
+}
+
+func Test_archiveTarGzipFilter(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockFilterTree)
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	_, err := archiveTarGzip(srcDir, outputFile, tarOptions{
+		Uid:    -1,
+		Gid:    -1,
+		Filter: pathFilter{Include: []string{"/output"}, Exclude: []string{"*.tmp", "__pycache__"}},
+	}, 0, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, header := range readTarGzipHeaders(t, outputFile) {
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, names, []string{"./", "./output/", "./output/result.txt"})
+}
+
+func Test_archiveUpperDirCopyFilter(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockFilterTree)
+	archiveTo := path.Join(outputDir, "archive")
+	_, err := archiveUpperDir(Archive{
+		Name:      "data",
+		ArchiveTo: archiveTo,
+		Include:   []string{"output"},
+		Exclude:   []string{"*.tmp", "__pycache__"},
+	}, srcDir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, exists := range map[string]bool{
+		"output/result.txt":  true,
+		"output/result.tmp":  false,
+		"output/__pycache__": false,
+		"others":             false,
+	} {
+		_, err = os.Stat(path.Join(archiveTo, file))
+		assert.Equal(t, err == nil, exists, fmt.Sprintf("%s exists", file))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// Keep the host uids and gids of the files as they are
+	IDMappingNone string = "none"
+	// Translate the host uids and gids of the files into the ones in the container user namespace
+	IDMappingContainer = "container"
+)
+
+var idMappings = []string{IDMappingNone, IDMappingContainer}
+
+// The uid and gid the host ids not mapped into the user namespace show up as, same as the kernel default
+// ref: https://www.kernel.org/doc/html/latest/admin-guide/sysctl/fs.html#overflowgid-overflowuid
+const overflowID = 65534
+
+func isValidIDMapping(mapping string) bool {
+	for _, idMapping := range idMappings {
+		if mapping == idMapping {
+			return true
+		}
+	}
+	return false
+}
+
+// idMapping translates the host uids and gids into the ones in the container user namespace
+type idMapping struct {
+	UIDMappings []spec.LinuxIDMapping
+	GIDMappings []spec.LinuxIDMapping
+}
+
+// archiveIDMapping returns the id mapping of the given archive from the user namespace of the container, nil is
+// returned if the ids are kept as they are or the container has no user namespace
+func archiveIDMapping(archive Archive, containerSpec spec.Spec) *idMapping {
+	if archive.IDMapping != IDMappingContainer || containerSpec.Linux == nil {
+		return nil
+	}
+	if len(containerSpec.Linux.UIDMappings) == 0 && len(containerSpec.Linux.GIDMappings) == 0 {
+		return nil
+	}
+	return &idMapping{UIDMappings: containerSpec.Linux.UIDMappings, GIDMappings: containerSpec.Linux.GIDMappings}
+}
+
+// mapID translates the host id with the given mappings, an id not in any of them becomes the overflow id, while
+// all ids are kept as they are without mappings
+func mapID(hostID int, mappings []spec.LinuxIDMapping) int {
+	if len(mappings) == 0 {
+		return hostID
+	}
+	for _, mapping := range mappings {
+		if hostID >= int(mapping.HostID) && hostID-int(mapping.HostID) < int(mapping.Size) {
+			return int(mapping.ContainerID) + hostID - int(mapping.HostID)
+		}
+	}
+	return overflowID
+}
+
+// ToContainer translates the host uid and gid into the ones in the container
+func (m *idMapping) ToContainer(uid int, gid int) (int, int) {
+	return mapID(uid, m.UIDMappings), mapID(gid, m.GIDMappings)
+}
+
+// chownToContainer chowns the file, or the symlink itself, at dest to the container ids of the host ids in fileInfo
+func (m *idMapping) chownToContainer(dest string, fileInfo os.FileInfo) error {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	uid, gid := m.ToContainer(int(stat.Uid), int(stat.Gid))
+	return os.Lchown(dest, uid, gid)
+}
+
+// chownTreeToContainer chowns everything in the folder from the host ids to the container ids
+func (m *idMapping) chownTreeToContainer(dir string) error {
+	return filepath.Walk(dir, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return m.chownToContainer(path, fileInfo)
+	})
+}
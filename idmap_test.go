@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+// The mappings of a rootless container with the user running podman as root in it
+var mockIDMapping = &idMapping{
+	UIDMappings: []spec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}, {ContainerID: 1, HostID: 100000, Size: 65536}},
+	GIDMappings: []spec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}, {ContainerID: 1, HostID: 100000, Size: 65536}},
+}
+
+func Test_idMappingToContainer(t *testing.T) {
+	for _, tt := range []struct {
+		hostID int
+		want   int
+	}{
+		{1000, 0},
+		{100000, 1},
+		{100999, 1000},
+		{165535, 65536},
+		{165536, overflowID},
+		{0, overflowID},
+	} {
+		uid, gid := mockIDMapping.ToContainer(tt.hostID, tt.hostID)
+		assert.Equal(t, uid, tt.want, tt.hostID)
+		assert.Equal(t, gid, tt.want, tt.hostID)
+	}
+	// The ids are kept as they are without mappings
+	uid, gid := (&idMapping{}).ToContainer(100999, 100999)
+	assert.Equal(t, uid, 100999)
+	assert.Equal(t, gid, 100999)
+}
+
+func Test_archiveIDMapping(t *testing.T) {
+	containerSpec := spec.Spec{Linux: &spec.Linux{
+		UIDMappings: mockIDMapping.UIDMappings,
+		GIDMappings: mockIDMapping.GIDMappings,
+	}}
+	assert.Nil(t, archiveIDMapping(Archive{}, containerSpec))
+	assert.Nil(t, archiveIDMapping(Archive{IDMapping: IDMappingNone}, containerSpec))
+	assert.Nil(t, archiveIDMapping(Archive{IDMapping: IDMappingContainer}, spec.Spec{}))
+	assert.Equal(t, archiveIDMapping(Archive{IDMapping: IDMappingContainer}, containerSpec), mockIDMapping)
+}
+
+// chownToHostIDs chowns the file to the host ids of a rootless container and sets the setuid bit
+func chownToHostIDs(t *testing.T, filePath string) {
+	if os.Getuid() != 0 {
+		t.Skip("Chown to other users requires root")
+	}
+	err := os.Chown(filePath, 100999, 101999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Chown clears the setuid bit, so it's set afterward
+	err = os.Chmod(filePath, 0755|fs.ModeSetuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_archiveTarGzipIDMapping(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, map[string]string{"file.txt": "MOCK_CONTENT"})
+	chownToHostIDs(t, path.Join(srcDir, "file.txt"))
+	outputDir := t.TempDir()
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	_, err := archiveTarGzip(srcDir, outputFile, tarOptions{Uid: -1, Gid: -1, IDMap: mockIDMapping}, 0, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := readTarGzipHeaders(t, outputFile)["./file.txt"]
+	assert.Equal(t, header.Uid, 1000)
+	assert.Equal(t, header.Gid, 2000)
+	assert.Equal(t, header.Uname, "")
+	assert.Equal(t, header.Gname, "")
+}
+
+func Test_copyTreeIDMapping(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, map[string]string{"file.txt": "MOCK_CONTENT"})
+	chownToHostIDs(t, path.Join(srcDir, "file.txt"))
+	destDir := t.TempDir()
+	err := copyTree(srcDir, destDir, copyOptions{IDMap: mockIDMapping})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Stat(path.Join(destDir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := fileInfo.Sys().(*syscall.Stat_t)
+	assert.Equal(t, stat.Uid, uint32(1000))
+	assert.Equal(t, stat.Gid, uint32(2000))
+	assert.Equal(t, fileInfo.Mode(), 0755|fs.ModeSetuid)
+}
+
+func Test_archiveOCIImageIDMapping(t *testing.T) {
+	lowerDir := t.TempDir()
+	writeTree(t, lowerDir, map[string]string{"file.txt": "BASE"})
+	chownToHostIDs(t, path.Join(lowerDir, "file.txt"))
+	upperDir := t.TempDir()
+	writeTree(t, upperDir, map[string]string{"file.txt": "MOCK_CONTENT"})
+	chownToHostIDs(t, path.Join(upperDir, "file.txt"))
+	layoutDir := path.Join(t.TempDir(), "image")
+	_, err := archiveOCIImage([]string{lowerDir}, upperDir, layoutDir, "data", tarOptions{Uid: -1, Gid: -1, IDMap: mockIDMapping})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexContent, err := os.ReadFile(path.Join(layoutDir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index ocispec.Index
+	err = json.Unmarshal(indexContent, &index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ocispec.Manifest
+	err = json.Unmarshal(readOCIBlob(t, layoutDir, index.Manifests[0]), &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both of the base and upper layers are mapped into the container
+	assert.Len(t, manifest.Layers, 2)
+	for _, layer := range manifest.Layers {
+		header := readTarGzipHeaders(t, path.Join(layoutDir, "blobs", "sha256", layer.Digest.Encoded()))["./file.txt"]
+		assert.Equal(t, header.Uid, 1000)
+		assert.Equal(t, header.Gid, 2000)
+	}
+}
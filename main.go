@@ -2,11 +2,12 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
 	spec "github.com/opencontainers/runtime-spec/specs-go"
-	cp "github.com/otiai10/copy"
 	"github.com/shirou/gopsutil/v3/process"
 	log "github.com/sirupsen/logrus"
 	logrusSyslog "github.com/sirupsen/logrus/hooks/syslog"
@@ -17,11 +18,23 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
+	// The exit code when any of the archives failed, all the archives are still attempted
+	ExitCodeArchiveFailed = 2
+)
+
+const (
+	configFlagName  = "config"
 	upperDirPrefix  = "upperdir="
+	lowerDirPrefix  = "lowerdir="
+	workDirPrefix   = "workdir="
 	defaultLogLevel = "info"
 )
 
@@ -30,46 +43,212 @@ var (
 	logLevel     = defaultLogLevel
 	useSyslog    = false
 	mountProgram = "/usr/bin/fuse-overlayfs"
+	// The strategy for discovering upperdir of bind mounts
+	upperDirDiscovery = UpperDirDiscoveryAuto
+	mountInfoPath     = "/proc/self/mountinfo"
+	dryRun            = false
+	// The host wide limits of all archives, zero means no limit
+	maxSizeValue = "0"
+	maxSize      int64
+	maxFiles     int64
+	// The max number of archives to archive concurrently
+	parallelism = 1
+	// The host side policy restricting the archives
+	configPath    = defaultConfigPath
+	archivePolicy Policy
+	// Look up the tar content owner names in the host if they are not found in the container
+	ownerHostFallback = false
 )
 
-func loadSpec(stateInput io.Reader) spec.Spec {
+func loadSpec(stateInput io.Reader) (spec.State, spec.Spec) {
 	var state spec.State
 	err := json.NewDecoder(stateInput).Decode(&state)
 	if err != nil {
 		log.Fatalf("Failed to parse stdin with error %s", err)
 	}
-	configPath := path.Join(state.Bundle, "config.json")
-	jsonFile, err := os.Open(configPath)
-	defer jsonFile.Close()
+	containerSpec, err := loadSpecFile(path.Join(state.Bundle, "config.json"))
 	if err != nil {
-		log.Fatalf("Failed to open OCI spec file %s with error %s", configPath, err)
+		log.Fatal(err)
 	}
+	return state, containerSpec
+}
+
+// loadSpecFile loads the OCI spec from the given config.json file
+func loadSpecFile(configPath string) (spec.Spec, error) {
 	var containerSpec spec.Spec
+	jsonFile, err := os.Open(configPath)
+	if err != nil {
+		return containerSpec, fmt.Errorf("failed to open OCI spec file %s with error %w", configPath, err)
+	}
+	defer jsonFile.Close()
 	err = json.NewDecoder(jsonFile).Decode(&containerSpec)
 	if err != nil {
-		log.Fatalf("Failed to parse OCI spec JSON file %s with error %s", configPath, err)
+		return containerSpec, fmt.Errorf("failed to parse OCI spec JSON file %s with error %w", configPath, err)
+	}
+	return containerSpec, nil
+}
+
+type tarOptions struct {
+	// The user (uid) to set for the files inside the tar archive, negative value means keeping it unchanged
+	Uid int
+	// The group (gid) to set for the files inside the tar archive, negative value means keeping it unchanged
+	Gid int
+	// Convert overlayfs whiteouts into OCI whiteout files
+	ConvertWhiteouts bool
+	// The xattr namespaces to include, all of them are included if it's empty
+	XattrInclude []string
+	// The xattr namespaces to exclude
+	XattrExclude []string
+	// The filter of paths to archive
+	Filter pathFilter
+	// The limits of the files archived
+	Quota archiveQuota
+	// The mapping of the host uids and gids into the container, nil means keeping them as they are
+	IDMap *idMapping
+	// The logger with the fields of the archive, nil means the standard logger
+	Logger *log.Entry
+}
+
+// logger returns the logger of the options or the standard logger if it's not set
+func (o tarOptions) logger() *log.Entry {
+	return archiveLogger(o.Logger)
+}
+
+// archiveLogger returns the given logger of an archive or the standard logger if it's nil
+func archiveLogger(logger *log.Entry) *log.Entry {
+	if logger == nil {
+		return log.NewEntry(log.StandardLogger())
 	}
-	return containerSpec
+	return logger
 }
 
-func archiveTarGzip(src string, archiveTo string, uid int, gid int) error {
+// fileID identifies a file by its device and inode numbers, for detecting hardlinks
+type fileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// pendingDir is a folder entry waiting to be written into the tar stream
+type pendingDir struct {
+	Header       *tar.Header
+	OpaqueHeader *tar.Header
+}
+
+// writeTar writes the given folder as a tar stream into the writer and returns the number of entries written
+func writeTar(src string, writer io.Writer, options tarOptions) (int64, error) {
 	// ref: https://golangdocs.com/tar-gzip-in-golang
 	// ref: https://github.com/containers/podman/blob/d09edd2820e25372c63e2a9d16a42b6d258b7f80/pkg/bindings/images/build.go#L633-L791
 	// ref: https://gist.github.com/mimoo/25fc9716e0f1353791f5908f94d6e726
-	archiveFile, err := os.OpenFile(archiveTo, os.O_CREATE|os.O_RDWR, os.FileMode(0644))
-	gzipWriter := gzip.NewWriter(archiveFile)
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer archiveFile.Close()
-	defer gzipWriter.Close()
+	tarWriter := tar.NewWriter(writer)
 	defer tarWriter.Close()
+	var entries int64
+	// The folders only walked into by the filter, they are written once anything in them is written
+	var pendingDirs []pendingDir
+	counter := &quotaCounter{Quota: options.Quota}
+	countEntry := func(header *tar.Header) error {
+		var size int64
+		if header.Typeflag == tar.TypeReg {
+			size = header.Size
+		}
+		if err := counter.Add(size); err != nil {
+			return err
+		}
+		entries++
+		return nil
+	}
+	writeEntry := func(header *tar.Header) error {
+		if err := countEntry(header); err != nil {
+			return err
+		}
+		return tarWriter.WriteHeader(header)
+	}
+	writePendingDirs := func(header *tar.Header) error {
+		for _, pending := range pendingDirs {
+			// The walk has left the folders which are not the parents, nothing in them comes after
+			if !strings.HasPrefix(header.Name, pending.Header.Name) {
+				continue
+			}
+			for _, pendingHeader := range []*tar.Header{pending.Header, pending.OpaqueHeader} {
+				if pendingHeader == nil {
+					continue
+				}
+				if err := writeEntry(pendingHeader); err != nil {
+					return err
+				}
+			}
+		}
+		pendingDirs = nil
+		return nil
+	}
+	writeHeader := func(header *tar.Header) error {
+		if err := writePendingDirs(header); err != nil {
+			return err
+		}
+		return writeEntry(header)
+	}
+	writeSparseFile := func(header *tar.Header, path string, fileInfo os.FileInfo) (bool, error) {
+		data, err := os.Open(path)
+		if err != nil {
+			return false, err
+		}
+		defer data.Close()
+		segments, err := findDataSegments(data, fileInfo.Size())
+		if err != nil {
+			return false, err
+		}
+		if dataSize(segments) == fileInfo.Size() {
+			return false, nil
+		}
+		if err := writePendingDirs(header); err != nil {
+			return false, err
+		}
+		if err := countEntry(header); err != nil {
+			return false, err
+		}
+		// The sparse entry is written around the tar writer, so its last entry has to be padded first
+		if err := tarWriter.Flush(); err != nil {
+			return false, err
+		}
+		return true, writeSparseTarEntry(writer, header, data, segments)
+	}
 
+	// The names of files with more than one link already in the archive
+	linkNames := map[fileID]string{}
 	srcPath, err := filepath.Abs(src)
+	if err != nil {
+		return 0, err
+	}
 	err = filepath.Walk(src, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		absPath, err := filepath.Abs(path)
 		if err != nil {
 			return err
 		}
-		header, err := tar.FileInfoHeader(fileInfo, fileInfo.Name())
+		relPath, err := filepath.Rel(srcPath, absPath)
+		if err != nil {
+			return err
+		}
+		action := options.Filter.Match(relPath, fileInfo.IsDir())
+		if action == filterExclude {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fileInfo.Mode()&fs.ModeSocket != 0 {
+			options.logger().Warnf("Skip archiving socket %s", path)
+			return nil
+		}
+		var linkTarget string
+		if fileInfo.Mode()&fs.ModeSymlink != 0 {
+			linkTarget, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(fileInfo, linkTarget)
 		if err != nil {
 			return err
 		}
@@ -81,22 +260,109 @@ func archiveTarGzip(src string, archiveTo string, uid int, gid int) error {
 		if absPath != srcPath && fileInfo.IsDir() {
 			header.Name += "/"
 		}
-		if uid >= 0 {
-			header.Uid = uid
+		if options.IDMap != nil {
+			header.Uid, header.Gid = options.IDMap.ToContainer(header.Uid, header.Gid)
+			// The host user and group names don't apply in the container
+			header.Uname = ""
+			header.Gname = ""
+		}
+		if options.Uid >= 0 {
+			header.Uid = options.Uid
 			header.Uname = ""
 		}
-		if gid >= 0 {
-			header.Gid = gid
+		if options.Gid >= 0 {
+			header.Gid = options.Gid
 			header.Gname = ""
 		}
-		if err := tarWriter.WriteHeader(header); err != nil {
+		var opaqueHeader *tar.Header
+		if options.ConvertWhiteouts {
+			// ref: https://github.com/containers/storage/blob/v1.48.0/pkg/archive/archive_linux.go
+			if isWhiteoutDevice(fileInfo) {
+				dir, name := filepath.Split(header.Name)
+				header.Name = dir + ociWhiteoutPrefix + name
+				header.Mode = 0600
+				header.Typeflag = tar.TypeReg
+				header.Size = 0
+				header.Devmajor = 0
+				header.Devminor = 0
+				return writeHeader(header)
+			}
+			if fileInfo.IsDir() {
+				opaque, err := isOpaqueDir(path)
+				if err != nil {
+					return err
+				}
+				if opaque {
+					opaqueHeader = &tar.Header{
+						Typeflag:   tar.TypeReg,
+						Mode:       header.Mode & int64(fs.ModePerm),
+						Name:       header.Name + ociWhiteoutOpaqueDir,
+						Size:       0,
+						Uid:        header.Uid,
+						Uname:      header.Uname,
+						Gid:        header.Gid,
+						Gname:      header.Gname,
+						ModTime:    header.ModTime,
+						AccessTime: header.AccessTime,
+						ChangeTime: header.ChangeTime,
+					}
+				}
+			}
+		}
+		xattrExclude := options.XattrExclude
+		if options.ConvertWhiteouts {
+			xattrExclude = append(append([]string{}, overlayXattrNamespaces...), xattrExclude...)
+		}
+		xattrs, err := readXattrs(path, options.XattrInclude, xattrExclude)
+		if err != nil {
 			return err
 		}
-		if !fileInfo.IsDir() && fileInfo.Mode()&fs.ModeDevice == 0 {
+		if len(xattrs) > 0 {
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
+			}
+			for name, value := range xattrs {
+				header.PAXRecords[paxSchilyXattr+name] = value
+			}
+			header.Format = tar.FormatPAX
+		}
+		if fileInfo.Mode().IsRegular() {
+			stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+			if ok && stat.Nlink > 1 {
+				id := fileID{Dev: uint64(stat.Dev), Ino: stat.Ino}
+				linkName, found := linkNames[id]
+				if found {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = linkName
+					header.Size = 0
+					return writeHeader(header)
+				}
+				linkNames[id] = header.Name
+			}
+			if isSparseFile(fileInfo) {
+				written, err := writeSparseFile(header, path, fileInfo)
+				if written || err != nil {
+					return err
+				}
+			}
+		}
+		if action == filterTraverse {
+			pendingDirs = append(pendingDirs, pendingDir{Header: header, OpaqueHeader: opaqueHeader})
+			return nil
+		}
+		if err := writeHeader(header); err != nil {
+			return err
+		}
+		if opaqueHeader != nil {
+			return writeHeader(opaqueHeader)
+		}
+		// Only regular files have content, opening a FIFO would block until something writes to it
+		if fileInfo.Mode().IsRegular() {
 			data, err := os.Open(path)
 			if err != nil {
 				return err
 			}
+			defer data.Close()
 			if _, err := io.Copy(tarWriter, data); err != nil {
 				return err
 			}
@@ -104,40 +370,273 @@ func archiveTarGzip(src string, archiveTo string, uid int, gid int) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return entries, err
+	}
+	return entries, tarWriter.Close()
+}
+
+// archiveTarOptions returns the tar options of the given archive with the id mapping
+func archiveTarOptions(archive Archive, convertWhiteouts bool, idMap *idMapping) tarOptions {
+	return tarOptions{
+		Uid:              archive.TarUser,
+		Gid:              archive.TarGroup,
+		ConvertWhiteouts: convertWhiteouts,
+		XattrInclude:     archive.XattrInclude,
+		XattrExclude:     archive.XattrExclude,
+		Filter:           archivePathFilter(archive),
+		Quota:            archiveQuotaLimits(archive),
+		IDMap:            idMap,
+		Logger:           log.WithField("archive", archive.Name),
+	}
+}
+
+// archivePathFilter returns the filter of paths to archive of the given archive
+func archivePathFilter(archive Archive) pathFilter {
+	return pathFilter{Include: archive.Include, Exclude: archive.Exclude}
+}
+
+// createArchiveFile creates a temp file next to the archive file and returns a writer counting and digesting the
+// written content along with the stats to be filled once the writing is done, the temp file needs to be committed
+// or discarded
+func createArchiveFile(archiveTo string) (*tempFile, io.Writer, func(files int64) archiveStats, error) {
+	archiveFile, err := createTempFile(archiveTo, 0644)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	digester := digest.Canonical.Digester()
+	counter := &countingWriter{}
+	stats := func(files int64) archiveStats {
+		return archiveStats{Files: files, Size: counter.Size, Digest: digester.Digest()}
+	}
+	return archiveFile, io.MultiWriter(archiveFile, digester.Hash(), counter), stats, nil
+}
+
+// archiveTarGzip archives the given folder as a tar.gz file, the blocks are compressed in parallel into a standard
+// gzip stream
+func archiveTarGzip(src string, archiveTo string, options tarOptions, level int, output outputOwnership) (archiveStats, error) {
+	archiveFile, writer, stats, err := createArchiveFile(archiveTo)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	defer archiveFile.Discard()
+	if level == 0 {
+		level = pgzip.DefaultCompression
+	}
+	gzipWriter, err := pgzip.NewWriterLevel(writer, level)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	defer gzipWriter.Close()
+	files, err := writeTar(src, gzipWriter, options)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return archiveStats{}, err
+	}
+	err = output.applyFile(archiveFile.File)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	return stats(files), archiveFile.Commit()
+}
+
+// archiveTarZstd archives the given folder as a tar.zst file, a zero level means the default zstd level
+func archiveTarZstd(src string, archiveTo string, options tarOptions, level int, output outputOwnership) (archiveStats, error) {
+	archiveFile, writer, stats, err := createArchiveFile(archiveTo)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	defer archiveFile.Discard()
+	zstdOptions := []zstd.EOption{}
+	if level != 0 {
+		zstdOptions = append(zstdOptions, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	zstdWriter, err := zstd.NewWriter(writer, zstdOptions...)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	defer zstdWriter.Close()
+	files, err := writeTar(src, zstdWriter, options)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	err = zstdWriter.Close()
+	if err != nil {
+		return archiveStats{}, err
+	}
+	err = output.applyFile(archiveFile.File)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	return stats(files), archiveFile.Commit()
+}
+
+// dirStats returns the stats of the given folder output
+func dirStats(dir string) (archiveStats, error) {
+	var stats archiveStats
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		stats.Files++
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stats.Size += fileInfo.Size()
+		return nil
+	})
+	return stats, err
+}
+
+// findMountOptions returns the overlay mount options of the given mount, the mount options of bind mounts are
+// looked up with the given finder
+func findMountOptions(mount spec.Mount, finder mountOptionsFinder, needLowerDirs bool) ([]string, error) {
+	if mount.Type == "overlay" {
+		// For root run, podman is going to use overlay directly and this will be an overlay mount
+		log.Debugf("Overlay mount found at %s with options %s", mount.Destination, mount.Options)
+		return mount.Options, nil
+	} else if mount.Type == "bind" {
+		// For rootless run, podman is going to use fuse-overlayfs mount, and this will be a
+		// bind mount, so we need to find out the options from mounts.
+		find := finder.FindMountOptions
+		if lowerDirsFinder, ok := finder.(lowerDirsMountOptionsFinder); ok && needLowerDirs {
+			// Only the oci-image method needs the lowerdirs, so the others don't wait for scanning the processes
+			find = lowerDirsFinder.FindMountOptionsWithLowerDirs
+		}
+		mountOptions, err := find(mount.Source)
+		if err != nil {
+			return nil, fmt.Errorf("no fuse mount found for %s with error %w", mount.Destination, err)
+		}
+		log.Debugf("Bind mount source fuse mount options %s found for %s", mountOptions, mount.Destination)
+		return mountOptions, nil
+	}
+	return nil, fmt.Errorf("unexpected mount type %s at %s, only overlay supported", mount.Type, mount.Destination)
+}
+
+// archiveDir writes a folder output into a temp folder next to archiveTo with the given function, sets its ownership,
+// then renames it to archiveTo, the temp folder is removed if anything goes wrong
+func archiveDir(archiveTo string, output outputOwnership, write func(stageDir string) (archiveStats, error)) (archiveStats, error) {
+	stageDir, err := createTempDir(archiveTo)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	defer stageDir.Discard()
+	stats, err := write(stageDir.Path)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	err = output.applyTree(stageDir.Path)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	_, err = stageDir.Commit()
+	return stats, err
+}
+
+// archiveUpperDir archives the upperdir with the method of the given archive
+func archiveUpperDir(archive Archive, upperDir string, lowerDirs []string, idMap *idMapping) (archiveStats, error) {
+	var method = archive.Method
+	if method == "" {
+		method = ArchiveMethodCopy
+	}
+	logger := log.WithField("archive", archive.Name)
+	if _, ok := methodCloneModes[method]; ok {
+		logger.Infof("Copying upperdir from %s to %s with method %s", upperDir, archive.ArchiveTo, method)
+		stats, err := archiveDir(archive.ArchiveTo, archiveOutputOwnership(archive), func(stageDir string) (archiveStats, error) {
+			err := copyTree(upperDir, stageDir, archiveCopyOptions(archive, method, idMap))
+			if err != nil {
+				return archiveStats{}, err
+			}
+			return dirStats(stageDir)
+		})
+		if err != nil {
+			return stats, fmt.Errorf("failed to copy from %s to %s with error %w", upperDir, archive.ArchiveTo, err)
+		}
+		return stats, nil
+	} else if method == ArchiveMethodMove {
+		logger.Infof("Moving upperdir content from %s to %s", upperDir, archive.ArchiveTo)
+		stats, err := archiveMove(upperDir, archive.ArchiveTo, archiveCopyOptions(archive, ArchiveMethodCopy, idMap), archiveOutputOwnership(archive))
+		if err != nil {
+			return stats, fmt.Errorf("failed to move from %s to %s with error %w", upperDir, archive.ArchiveTo, err)
+		}
+		return stats, nil
+	} else if method == ArchiveMethodTarGzip {
+		logger.Infof("Archiving upperdir from %s to %s", upperDir, archive.ArchiveTo)
+		stats, err := archiveTarGzip(upperDir, archive.ArchiveTo, archiveTarOptions(archive, false, idMap), archive.CompressionLevel, archiveOutputOwnership(archive))
+		if err != nil {
+			return stats, fmt.Errorf("failed to archive tar.gz from %s to %s with error %w", upperDir, archive.ArchiveTo, err)
+		}
+		return stats, nil
+	} else if method == ArchiveMethodOCILayer {
+		logger.Infof("Archiving upperdir from %s to OCI layer %s", upperDir, archive.ArchiveTo)
+		stats, err := archiveTarGzip(upperDir, archive.ArchiveTo, archiveTarOptions(archive, true, idMap), archive.CompressionLevel, archiveOutputOwnership(archive))
+		if err != nil {
+			return stats, fmt.Errorf("failed to archive OCI layer from %s to %s with error %w", upperDir, archive.ArchiveTo, err)
+		}
+		return stats, nil
+	} else if method == ArchiveMethodTarZstd {
+		logger.Infof("Archiving upperdir from %s to %s", upperDir, archive.ArchiveTo)
+		stats, err := archiveTarZstd(upperDir, archive.ArchiveTo, archiveTarOptions(archive, false, idMap), archive.CompressionLevel, archiveOutputOwnership(archive))
+		if err != nil {
+			return stats, fmt.Errorf("failed to archive tar.zst from %s to %s with error %w", upperDir, archive.ArchiveTo, err)
+		}
+		return stats, nil
+	} else if method == ArchiveMethodOCIImage {
+		logger.Infof("Archiving upperdir from %s on top of lowerdirs %s to OCI image %s", upperDir, lowerDirs, archive.ArchiveTo)
+		stats, err := archiveDir(archive.ArchiveTo, archiveOutputOwnership(archive), func(stageDir string) (archiveStats, error) {
+			return archiveOCIImage(lowerDirs, upperDir, stageDir, archive.Name, archiveTarOptions(archive, false, idMap))
+		})
+		if err != nil {
+			return stats, fmt.Errorf("failed to archive OCI image from %s to %s with error %w", upperDir, archive.ArchiveTo, err)
+		}
+		return stats, nil
 	}
-	return nil
+	return archiveStats{}, fmt.Errorf("unknown archive method %s", method)
+}
+
+// resolvedArchive is an archive with the upperdir and lowerdirs of its mount resolved
+type resolvedArchive struct {
+	Archive   Archive
+	UpperDir  string
+	LowerDirs []string
+	// The mapping of the host uids and gids into the container, nil means keeping them as they are
+	IDMap *idMapping
+	// The error of resolving the upperdir
+	Err error
 }
 
-func archiveUpperDirs(containerSpec spec.Spec, mountPointArchives map[string]Archive) {
-	var fuseMountListed = false
-	var fuseMountOptions = map[string][]string{}
+// resolveUpperDirs resolves upperdirs and tar content owner names of the given archives in the order of mounts in
+// the spec, the archives with mount point not found in the spec are skipped
+func resolveUpperDirs(bundle string, containerSpec spec.Spec, mountPointArchives map[string]Archive) []resolvedArchive {
+	finder, finderErr := newMountOptionsFinder(upperDirDiscovery)
+	var resolvedArchives []resolvedArchive
+	resolved := map[string]bool{}
 	for _, mount := range containerSpec.Mounts {
 		archive, ok := mountPointArchives[mount.Destination]
 		if !ok {
 			log.Tracef("Cannot find mount point %s to archive, skip", mount.Destination)
 			continue
 		}
-		var mountOptions []string
-		if mount.Type == "overlay" {
-			// For root run, podman is going to use overlay directly and this will be an overlay mount
-			log.Debugf("Overlay mount found at %s with options %s", mount.Destination, mount.Options)
-			mountOptions = mount.Options
-		} else if mount.Type == "bind" {
-			if !fuseMountListed {
-				fuseMountOptions = listFuseMountOptions()
-				fuseMountListed = true
-			}
-			// For rootless run, podman is going to use fuse-overlayfs mount, and this will be a
-			// bind mount, so we need to find out the options from mounts.
-			mountOptions, ok = fuseMountOptions[mount.Source]
-			if !ok {
-				log.Fatalf("No fuse mount found for %s", mount.Destination)
-				continue
-			}
-			log.Debugf("Bind mount source fuse mount options %s found for %s", fuseMountOptions, mount.Destination)
-		} else {
-			log.Fatalf("Unexpected mount type %s at %s, only overlay supported", mount.Type, mount.Destination)
+		resolved[mount.Destination] = true
+		archive, err := resolveTarOwner(archive, bundle, containerSpec)
+		if err != nil {
+			resolvedArchives = append(resolvedArchives, resolvedArchive{Archive: archive, Err: err})
+			continue
+		}
+		if finderErr != nil {
+			resolvedArchives = append(resolvedArchives, resolvedArchive{Archive: archive, Err: finderErr})
+			continue
+		}
+		mountOptions, err := findMountOptions(mount, finder, archive.Method == ArchiveMethodOCIImage)
+		if err != nil {
+			resolvedArchives = append(resolvedArchives, resolvedArchive{Archive: archive, Err: err})
+			continue
 		}
 		var upperDir = ""
 		for _, option := range mountOptions {
@@ -147,47 +646,164 @@ func archiveUpperDirs(containerSpec spec.Spec, mountPointArchives map[string]Arc
 			}
 		}
 		if upperDir == "" {
-			log.WithFields(log.Fields{"mount": mount}).Fatalf(
+			log.WithFields(log.Fields{"mount": mount}).Errorf(
 				"Cannot find upperdir for archive %s in mount with mount options %s",
 				archive.Name,
 				mountOptions,
 			)
+			resolvedArchives = append(resolvedArchives, resolvedArchive{
+				Archive: archive,
+				Err:     fmt.Errorf("cannot find upperdir in mount options %s", mountOptions),
+			})
+			continue
 		}
 
-		var method = archive.Method
-		if method == "" {
-			method = ArchiveMethodCopy
-		}
-		if method == ArchiveMethodCopy {
-			log.Infof("Copying upperdir from %s to %s for archive %s", upperDir, archive.ArchiveTo, archive.Name)
-			err := cp.Copy(upperDir, archive.ArchiveTo)
-			if err != nil {
-				log.Fatalf("Failed to copy from %s to %s for archive %s with error %s", upperDir, archive.ArchiveTo, archive.Name, err)
-			}
-		} else if method == ArchiveMethodTarGzip {
-			log.Infof("Archiving upperdir from %s to %s for archive %s", upperDir, archive.ArchiveTo, archive.Name)
-			err := archiveTarGzip(upperDir, archive.ArchiveTo, archive.TarUser, archive.TarGroup)
-			if err != nil {
-				log.Fatalf("Failed to archive tar.gz from %s to %s for archive %s with error %s", upperDir, archive.ArchiveTo, archive.Name, err)
+		var lowerDirs []string
+		var workDir string
+		for _, option := range mountOptions {
+			if strings.HasPrefix(option, lowerDirPrefix) {
+				lowerDirs = parseLowerDirs(option[len(lowerDirPrefix):])
+			} else if strings.HasPrefix(option, workDirPrefix) {
+				workDir = option[len(workDirPrefix):]
 			}
-		} else {
-			log.Fatalf("Unknown archive method %s", method)
 		}
-		if archive.ArchiveSuccess != "" {
-			err := os.WriteFile(archive.ArchiveSuccess, []byte{}, 0644)
-			if err != nil {
-				log.Fatalf("Failed to write archive success file %s for archive %s with error %s", archive.ArchiveSuccess, archive.Name, err)
+		lowerDirs, err = resolveLowerDirs(lowerDirs, workDir)
+		if err != nil {
+			// Only the oci-image method needs the lowerdirs, it fails without them later
+			log.Warnf("Cannot resolve lowerdirs for archive %s with error %s", archive.Name, err)
+		}
+		resolvedArchives = append(resolvedArchives, resolvedArchive{
+			Archive:   archive,
+			UpperDir:  upperDir,
+			LowerDirs: lowerDirs,
+			IDMap:     archiveIDMapping(archive, containerSpec),
+		})
+	}
+
+	// Pod level annotations are copied onto every container of the pod, so the mount point of an archive may belong
+	// to another container
+	var missingArchives []Archive
+	for mountPoint, archive := range mountPointArchives {
+		if !resolved[mountPoint] {
+			missingArchives = append(missingArchives, archive)
+		}
+	}
+	sort.Slice(missingArchives, func(i, j int) bool {
+		return missingArchives[i].Name < missingArchives[j].Name
+	})
+	for _, archive := range missingArchives {
+		log.WithField("archive", archive.Name).Warnf("Cannot find mount point %s in the spec, skip", archive.MountPoint)
+	}
+	return resolvedArchives
+}
+
+// archiveResolvedUpperDir archives the upperdir of the given resolved archive and writes its success file
+func archiveResolvedUpperDir(state spec.State, resolved resolvedArchive) ArchiveResult {
+	result := newArchiveResult(resolved.Archive)
+	result.UpperDir = resolved.UpperDir
+	if resolved.Err != nil {
+		return result.failed(resolved.Err)
+	}
+	startedAt := time.Now().UTC()
+	stats, err := archiveUpperDir(resolved.Archive, resolved.UpperDir, resolved.LowerDirs, resolved.IDMap)
+	if err != nil {
+		return result.failed(err)
+	}
+	finishedAt := time.Now().UTC()
+	err = writeArchiveSuccess(resolved.Archive, newArchiveManifest(state, result, stats, startedAt, finishedAt))
+	if err != nil {
+		return result.failed(err)
+	}
+	log.WithField("archive", resolved.Archive.Name).Infof("Archived upperdir %s in %s", resolved.UpperDir, finishedAt.Sub(startedAt))
+	result.Status = ArchiveStatusSucceeded
+	return result
+}
+
+// archiveUpperDirs archives upperdirs of all the given archives, a failed archive doesn't stop the others from
+// being archived. The upperdirs are resolved one by one, then archived concurrently by up to parallelism workers,
+// the results are returned in the order of mounts in the spec regardless.
+func archiveUpperDirs(state spec.State, containerSpec spec.Spec, mountPointArchives map[string]Archive) []ArchiveResult {
+	resolvedArchives := resolveUpperDirs(state.Bundle, containerSpec, mountPointArchives)
+	results := make([]ArchiveResult, len(resolvedArchives))
+	indexes := make(chan int)
+	var waitGroup sync.WaitGroup
+	for worker := 0; worker < parallelism && worker < len(resolvedArchives); worker++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := range indexes {
+				results[i] = archiveResolvedUpperDir(state, resolvedArchives[i])
 			}
+		}()
+	}
+	for i := range resolvedArchives {
+		indexes <- i
+	}
+	close(indexes)
+	waitGroup.Wait()
+
+	for _, result := range results {
+		if result.Status == ArchiveStatusSucceeded {
+			continue
+		}
+		log.WithField("archive", result.Name).Errorf("Failed to archive with error %s", result.Error)
+	}
+	return results
+}
+
+// resolveLowerDirs resolves the relative lowerdirs, such as the l/<id> short links containers/storage mounts with to
+// keep the mount options short, against the overlay dir the layer of the workdir is in
+func resolveLowerDirs(lowerDirs []string, workDir string) ([]string, error) {
+	var resolved []string
+	for _, lowerDir := range lowerDirs {
+		if filepath.IsAbs(lowerDir) {
+			resolved = append(resolved, lowerDir)
+			continue
+		}
+		if !filepath.IsAbs(workDir) {
+			return nil, fmt.Errorf("cannot resolve relative lowerdir %s without absolute workdir", lowerDir)
 		}
+		// The workdir is at <overlay>/<layer-id>/work
+		lowerDir, err := filepath.EvalSymlinks(filepath.Join(filepath.Dir(filepath.Dir(workDir)), lowerDir))
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, lowerDir)
 	}
+	return resolved, nil
 }
 
-func listFuseMountOptions() map[string][]string {
+// parseLowerDirs parses the value of lowerdir mount option and returns the lower dirs from the bottom to the top
+func parseLowerDirs(value string) []string {
+	var lowerDirs []string
+	var current strings.Builder
+	for i := 0; i < len(value); i++ {
+		// Colons in the path are escaped with backslash
+		// ref: https://docs.kernel.org/filesystems/overlayfs.html#multiple-lower-layers
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+			current.WriteByte(value[i])
+			continue
+		}
+		if value[i] == ':' {
+			lowerDirs = append([]string{current.String()}, lowerDirs...)
+			current.Reset()
+			continue
+		}
+		current.WriteByte(value[i])
+	}
+	if current.Len() > 0 {
+		lowerDirs = append([]string{current.String()}, lowerDirs...)
+	}
+	return lowerDirs
+}
+
+func listFuseMountOptions() (map[string][]string, error) {
 	log.Infof("Enumerate fuse mount processes with mount program %s ...", mountProgram)
 	mountOptions := map[string][]string{}
 	processes, err := process.Processes()
 	if err != nil {
-		log.Fatalf("Failed to fetch processes")
+		return nil, fmt.Errorf("failed to fetch processes with error %w", err)
 	}
 	for _, proc := range processes {
 		exe, err := proc.Exe()
@@ -228,21 +844,51 @@ func listFuseMountOptions() map[string][]string {
 		}
 		mountOptions[fuseMountPoint] = strings.Split(fuseMountOption, ",")
 	}
-	return mountOptions
+	return mountOptions, nil
 }
 
-func run() {
-	containerSpec := loadSpec(os.Stdin)
-	destArchives := parseArchives(containerSpec.Annotations)
+// loadArchives loads the OCI spec with the state from the given input and parses the archives from it
+func loadArchives(stateInput io.Reader) (spec.State, spec.Spec, map[string]Archive) {
+	state, containerSpec := loadSpec(stateInput)
+	destArchives, errs := parseArchives(containerSpec.Annotations, archivePolicy)
+	for _, err := range errs {
+		log.Warnf("Ignored invalid archive annotation: %s", err)
+	}
 	archivesJson, err := json.Marshal(destArchives)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Debugf("Parsed archives: %s", string(archivesJson))
-	archiveUpperDirs(containerSpec, destArchives)
+	return state, containerSpec, destArchives
+}
+
+func run() {
+	state, containerSpec, destArchives := loadArchives(os.Stdin)
+	results := archiveUpperDirs(state, containerSpec, destArchives)
+	resultsJson, err := json.Marshal(results)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Debugf("Archive results: %s", string(resultsJson))
+	failedCount := countFailedResults(results)
+	if failedCount > 0 {
+		log.Errorf("Failed to archive %d out of %d archives", failedCount, len(results))
+		os.Exit(ExitCodeArchiveFailed)
+	}
 	log.Infof("Done")
 }
 
+// countFailedResults counts the archives not succeeded
+func countFailedResults(results []ArchiveResult) int {
+	failedCount := 0
+	for _, result := range results {
+		if result.Status != ArchiveStatusSucceeded {
+			failedCount++
+		}
+	}
+	return failedCount
+}
+
 func setupLogLevel() {
 	var found = false
 	for _, level := range LogLevels {
@@ -264,6 +910,44 @@ func setupLogLevel() {
 	log.SetLevel(level)
 }
 
+func setupUpperDirDiscovery() {
+	_, err := newMountOptionsFinder(upperDirDiscovery)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func setupQuota() {
+	size, err := parseSize(maxSizeValue)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid max size %s with error %s\n", maxSizeValue, err)
+		os.Exit(1)
+	}
+	maxSize = size
+	if maxFiles < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid max files %d\n", maxFiles)
+		os.Exit(1)
+	}
+}
+
+func setupParallelism() {
+	if parallelism < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid parallelism %d, expected at least 1\n", parallelism)
+		os.Exit(1)
+	}
+}
+
+func setupPolicy(cmd *cobra.Command) {
+	// The default policy file is optional, but the one given explicitly has to exist
+	policy, err := loadPolicyFile(configPath, cmd.Flags().Changed(configFlagName))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	archivePolicy = policy
+}
+
 func initSyslog() {
 	if !useSyslog {
 		return
@@ -290,7 +974,15 @@ func main() {
 		Version: Version,
 		Run: func(cmd *cobra.Command, args []string) {
 			setupLogLevel()
+			setupUpperDirDiscovery()
+			setupQuota()
+			setupParallelism()
+			setupPolicy(cmd)
 			log.Infof("Run archive_overlay %s", Version)
+			if dryRun {
+				runPlan(os.Stdin, cmd.OutOrStdout())
+				return
+			}
 			run()
 		},
 	}
@@ -319,6 +1011,66 @@ func main() {
 		fmt.Sprintf("The paht to mount program used by the OCI runtime, used for looking up fuse mount options"),
 	)
 
+	maxSizeFlagName := "max-size"
+	pFlags.StringVar(
+		&maxSizeValue,
+		maxSizeFlagName,
+		maxSizeValue,
+		"The host wide max total size of files in each archive with optional K, M, G or T suffix, 0 means no limit",
+	)
+
+	maxFilesFlagName := "max-files"
+	pFlags.Int64Var(
+		&maxFiles,
+		maxFilesFlagName,
+		maxFiles,
+		"The host wide max number of files in each archive, 0 means no limit",
+	)
+
+	parallelismFlagName := "parallelism"
+	pFlags.IntVar(
+		&parallelism,
+		parallelismFlagName,
+		parallelism,
+		"The max number of archives to archive concurrently",
+	)
+
+	pFlags.StringVar(
+		&configPath,
+		configFlagName,
+		configPath,
+		"The path to the policy JSON file restricting archive destinations and methods, everything is allowed if the default one doesn't exist",
+	)
+
+	ownerHostFallbackFlagName := "owner-host-fallback"
+	pFlags.BoolVar(
+		&ownerHostFallback,
+		ownerHostFallbackFlagName,
+		ownerHostFallback,
+		"Look up the user and group names of tar-content-owner in the host if they are not found in the container rootfs",
+	)
+
+	rootCmd.Flags().BoolVar(
+		&dryRun,
+		"dry-run",
+		dryRun,
+		"Print the archive plan as JSON without writing anything, same as the plan subcommand",
+	)
+	rootCmd.AddCommand(newValidateCmd())
+	rootCmd.AddCommand(newPlanCmd())
+
+	upperDirDiscoveryFlagName := "upperdir-discovery"
+	pFlags.StringVar(
+		&upperDirDiscovery,
+		upperDirDiscoveryFlagName,
+		upperDirDiscovery,
+		fmt.Sprintf(
+			"The strategy for discovering upperdir of bind mounts (%s), "+
+				"auto tries mountinfo first then falls back to process and storage",
+			strings.Join(UpperDirDiscoveries, ", "),
+		),
+	)
+
 	err := rootCmd.Execute()
 	if err != nil {
 		log.Fatal(err)
@@ -6,16 +6,44 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	spec "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+	logTest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 	"io"
 	"io/fs"
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
 )
 
+// writeTree writes the files with the given content into the root folder along with their parent folders, a path
+// ending with a slash is created as an empty folder
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		filePath := path.Join(root, name)
+		if strings.HasSuffix(name, "/") {
+			err := os.MkdirAll(filePath, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		err := os.MkdirAll(path.Dir(filePath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filePath, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func Test_loadSpec(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "bundle")
 	if err != nil {
@@ -44,7 +72,7 @@ func Test_loadSpec(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	resultSpec := loadSpec(bytes.NewReader(stateData))
+	_, resultSpec := loadSpec(bytes.NewReader(stateData))
 	assert.True(t, reflect.DeepEqual(resultSpec, specValue))
 }
 
@@ -109,7 +137,17 @@ func Test_archiveUpperDirs(t *testing.T) {
 			Name:           "data",
 		},
 	}
-	archiveUpperDirs(containerSpec, archives)
+	results := archiveUpperDirs(spec.State{}, containerSpec, archives)
+	assert.Equal(t, results, []ArchiveResult{
+		{
+			Name:       "data",
+			MountPoint: "/data",
+			UpperDir:   srcDir,
+			Method:     ArchiveMethodCopy,
+			ArchiveTo:  destDir,
+			Status:     ArchiveStatusSucceeded,
+		},
+	})
 
 	destNestedFileDir := path.Join(destDir, "nested", "dir")
 	destNestedFilePath := path.Join(destNestedFileDir, "file.txt")
@@ -163,7 +201,7 @@ func Test_archiveTarGzip(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = archiveTarGzip(srcDir, outputFile, 2000, 3000)
+	_, err = archiveTarGzip(srcDir, outputFile, tarOptions{Uid: 2000, Gid: 3000}, 0, outputOwnership{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -196,3 +234,538 @@ func Test_archiveTarGzip(t *testing.T) {
 		assert.Equal(t, tarHeaders[name].Gname, "")
 	}
 }
+
+func Test_archiveTarGzipParallelBlocks(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	// Larger than a few compression blocks, so that they are compressed in parallel
+	fileData := bytes.Repeat([]byte("MOCK_CONTENT_"), 1024*1024)
+	err := os.WriteFile(path.Join(srcDir, "file.txt"), fileData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	_, err = archiveTarGzip(srcDir, outputFile, tarOptions{Uid: -1, Gid: -1}, 9, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The output is a standard gzip stream readable by compress/gzip
+	extractDir := t.TempDir()
+	extractTarGzip(t, outputFile, extractDir)
+	content, err := os.ReadFile(path.Join(extractDir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, bytes.Equal(content, fileData))
+}
+
+func Test_archiveTarZstd(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	nestedFileData := []byte("MOCK_CONTENT")
+	nestedFileDir := path.Join(srcDir, "nested", "dir")
+	nestedFilePath := path.Join(nestedFileDir, "file.txt")
+	err := os.MkdirAll(nestedFileDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(nestedFilePath, nestedFileData, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputFile := path.Join(outputDir, "output.tar.zst")
+	_, err = archiveTarZstd(srcDir, outputFile, tarOptions{Uid: 2000, Gid: 3000}, 19, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileReader, err := os.Open(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+
+	zstdReader, err := zstd.NewReader(fileReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zstdReader.Close()
+	tarReader := tar.NewReader(zstdReader)
+	tarHeaders := map[string]tar.Header{}
+	var fileContent []byte
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		tarHeaders[header.Name] = *header
+		if header.Name == "./nested/dir/file.txt" {
+			fileContent, err = io.ReadAll(tarReader)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, name := range []string{"./", "./nested/", "./nested/dir/", "./nested/dir/file.txt"} {
+		assert.Contains(t, tarHeaders, name)
+		assert.Equal(t, tarHeaders[name].Uid, 2000)
+		assert.Equal(t, tarHeaders[name].Gid, 3000)
+	}
+	assert.Equal(t, string(fileContent), string(nestedFileData))
+}
+
+func readTarGzipHeaders(t *testing.T, archivePath string) map[string]tar.Header {
+	fileReader, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	gzipReader, err := gzip.NewReader(fileReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	tarHeaders := map[string]tar.Header{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		tarHeaders[header.Name] = *header
+	}
+	return tarHeaders
+}
+
+func Test_archiveTarGzipConvertWhiteouts(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	nestedFileDir := path.Join(srcDir, "nested", "dir")
+	err := os.MkdirAll(nestedFileDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unix.Mknod(path.Join(nestedFileDir, "deleted.txt"), unix.S_IFCHR, 0)
+	if err != nil {
+		t.Skipf("Cannot create whiteout device with error %s", err)
+	}
+	err = unix.Setxattr(path.Join(srcDir, "nested"), "user.overlay.opaque", []byte("y"), 0)
+	if err != nil {
+		t.Skipf("Cannot set opaque xattr with error %s", err)
+	}
+
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	_, err = archiveTarGzip(srcDir, outputFile, tarOptions{Uid: -1, Gid: -1, ConvertWhiteouts: true}, 0, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarHeaders := readTarGzipHeaders(t, outputFile)
+	assert.NotContains(t, tarHeaders, "./nested/dir/deleted.txt")
+	assert.Contains(t, tarHeaders, "./nested/dir/.wh.deleted.txt")
+	assert.Equal(t, tarHeaders["./nested/dir/.wh.deleted.txt"].Typeflag, byte(tar.TypeReg))
+	assert.Contains(t, tarHeaders, "./nested/.wh..wh..opq")
+	assert.Equal(t, tarHeaders["./nested/.wh..wh..opq"].Typeflag, byte(tar.TypeReg))
+	assert.NotContains(t, tarHeaders, "./nested/dir/.wh..wh..opq")
+}
+
+func Test_resolveLowerDirs(t *testing.T) {
+	overlayDir := t.TempDir()
+	writeTree(t, overlayDir, map[string]string{"base/diff/": "", "layer/work/": ""})
+	err := os.MkdirAll(path.Join(overlayDir, "l"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("../base/diff", path.Join(overlayDir, "l", "BASE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := path.Join(overlayDir, "layer", "work")
+	lowerDirs, err := resolveLowerDirs([]string{"/path/to/lower", "l/BASE"}, workDir)
+	assert.NoError(t, err)
+	assert.Equal(t, lowerDirs, []string{"/path/to/lower", path.Join(overlayDir, "base", "diff")})
+	_, err = resolveLowerDirs([]string{"l/BASE"}, "")
+	assert.Error(t, err)
+	_, err = resolveLowerDirs([]string{"l/MISSING"}, workDir)
+	assert.Error(t, err)
+}
+
+func Test_parseLowerDirs(t *testing.T) {
+	assert.Equal(t, parseLowerDirs("/path/to/lower"), []string{"/path/to/lower"})
+	assert.Equal(t, parseLowerDirs("/path/to/top:/path/to/bottom"), []string{"/path/to/bottom", "/path/to/top"})
+	assert.Equal(t, parseLowerDirs(`/path/to/es\:caped:/path/to/bottom`), []string{"/path/to/bottom", "/path/to/es:caped"})
+}
+
+func Test_archiveTarGzipXattrs(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	filePath := path.Join(srcDir, "file.txt")
+	err := os.WriteFile(filePath, []byte("MOCK_CONTENT"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"user.mime_type": "text/plain", "user.comment": "MOCK_COMMENT"} {
+		err = unix.Lsetxattr(filePath, name, []byte(value), 0)
+		if err != nil {
+			t.Skipf("Cannot set xattr with error %s", err)
+		}
+	}
+
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	_, err = archiveTarGzip(srcDir, outputFile, tarOptions{Uid: -1, Gid: -1, XattrExclude: []string{"user.comment"}}, 0, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarHeaders := readTarGzipHeaders(t, outputFile)
+	assert.Contains(t, tarHeaders, "./file.txt")
+	records := tarHeaders["./file.txt"].PAXRecords
+	assert.Equal(t, records["SCHILY.xattr.user.mime_type"], "text/plain")
+	assert.NotContains(t, records, "SCHILY.xattr.user.comment")
+}
+
+func extractTarGzip(t *testing.T, archivePath string, dest string) {
+	fileReader, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileReader.Close()
+	gzipReader, err := gzip.NewReader(fileReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		target := path.Join(dest, header.Name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, fs.FileMode(header.Mode).Perm())
+		case tar.TypeReg:
+			var data []byte
+			data, err = io.ReadAll(tarReader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(target, data, fs.FileMode(header.Mode).Perm())
+		case tar.TypeLink:
+			err = os.Link(path.Join(dest, header.Linkname), target)
+		default:
+			t.Fatalf("Unexpected type %c of %s", header.Typeflag, header.Name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_archiveTarGzipHardlinks(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	err := os.MkdirAll(path.Join(srcDir, "nested"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileData := []byte("MOCK_CONTENT")
+	err = os.WriteFile(path.Join(srcDir, "a.txt"), fileData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Link(path.Join(srcDir, "a.txt"), path.Join(srcDir, "nested", "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(srcDir, "c.txt"), fileData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	_, err = archiveTarGzip(srcDir, outputFile, tarOptions{Uid: -1, Gid: -1}, 0, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarHeaders := readTarGzipHeaders(t, outputFile)
+	assert.Equal(t, tarHeaders["./a.txt"].Typeflag, byte(tar.TypeReg))
+	assert.Equal(t, tarHeaders["./nested/b.txt"].Typeflag, byte(tar.TypeLink))
+	assert.Equal(t, tarHeaders["./nested/b.txt"].Linkname, "./a.txt")
+	assert.Equal(t, tarHeaders["./c.txt"].Typeflag, byte(tar.TypeReg))
+
+	extractDir := t.TempDir()
+	extractTarGzip(t, outputFile, extractDir)
+	aInfo, err := os.Stat(path.Join(extractDir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bInfo, err := os.Stat(path.Join(extractDir, "nested", "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cInfo, err := os.Stat(path.Join(extractDir, "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, os.SameFile(aInfo, bInfo))
+	assert.False(t, os.SameFile(aInfo, cInfo))
+	resultData, err := os.ReadFile(path.Join(extractDir, "nested", "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(resultData), string(fileData))
+}
+
+func Test_archiveUpperDirsPartialFailure(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	err := os.WriteFile(path.Join(srcDir, "file.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerSpec := spec.Spec{
+		Version: spec.Version,
+		Mounts: []spec.Mount{
+			{
+				Destination: "/tmp",
+				Source:      "tmpfs",
+				Type:        "tmpfs",
+			},
+			{
+				Destination: "/no-upperdir",
+				Source:      "/path/to/source",
+				Type:        "overlay",
+				Options:     []string{"lowerdir=/path/to/lower"},
+			},
+			{
+				Destination: "/data",
+				Source:      "/path/to/source",
+				Type:        "overlay",
+				Options:     []string{fmt.Sprintf("upperdir=%s", srcDir)},
+			},
+		},
+	}
+	archives := map[string]Archive{
+		"/tmp": {
+			Name:           "tmp",
+			MountPoint:     "/tmp",
+			ArchiveTo:      path.Join(outputDir, "tmp"),
+			ArchiveSuccess: path.Join(outputDir, "tmp-success"),
+		},
+		"/no-upperdir": {
+			Name:           "no-upperdir",
+			MountPoint:     "/no-upperdir",
+			ArchiveTo:      path.Join(outputDir, "no-upperdir"),
+			ArchiveSuccess: path.Join(outputDir, "no-upperdir-success"),
+		},
+		"/data": {
+			Name:           "data",
+			MountPoint:     "/data",
+			ArchiveTo:      path.Join(outputDir, "data"),
+			ArchiveSuccess: path.Join(outputDir, "data-success"),
+		},
+	}
+	results := archiveUpperDirs(spec.State{}, containerSpec, archives)
+	var statuses []string
+	var names []string
+	for _, result := range results {
+		names = append(names, result.Name)
+		statuses = append(statuses, result.Status)
+		if result.Status == ArchiveStatusFailed {
+			assert.NotEmpty(t, result.Error)
+		}
+	}
+	assert.Equal(t, names, []string{"tmp", "no-upperdir", "data"})
+	assert.Equal(t, statuses, []string{ArchiveStatusFailed, ArchiveStatusFailed, ArchiveStatusSucceeded})
+
+	_, err = os.Stat(path.Join(outputDir, "data", "file.txt"))
+	assert.Nil(t, err)
+	_, err = os.Stat(path.Join(outputDir, "data-success"))
+	assert.Nil(t, err)
+	for _, name := range []string{"tmp-success", "no-upperdir-success"} {
+		_, err = os.Stat(path.Join(outputDir, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func Test_archiveUpperDirsMissingMountPointSkipped(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, map[string]string{"file.txt": "MOCK_CONTENT"})
+	containerSpec := spec.Spec{
+		Version: spec.Version,
+		Mounts: []spec.Mount{
+			{
+				Destination: "/data",
+				Source:      "/path/to/source",
+				Type:        "overlay",
+				Options:     []string{fmt.Sprintf("upperdir=%s", srcDir)},
+			},
+		},
+	}
+	archives := map[string]Archive{
+		"/data": {
+			Name:           "data",
+			MountPoint:     "/data",
+			ArchiveTo:      path.Join(outputDir, "data"),
+			ArchiveSuccess: path.Join(outputDir, "data-success"),
+		},
+		"/missing": {
+			Name:           "missing",
+			MountPoint:     "/missing",
+			ArchiveTo:      path.Join(outputDir, "missing"),
+			ArchiveSuccess: path.Join(outputDir, "missing-success"),
+		},
+	}
+	// The archive with mount point not in the spec may be for another container of the pod, it's skipped with a
+	// warning instead of failing the hook
+	hook := logTest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	results := archiveUpperDirs(spec.State{}, containerSpec, archives)
+	assert.Len(t, results, 1)
+	assert.Equal(t, results[0].Name, "data")
+	assert.Equal(t, results[0].Status, ArchiveStatusSucceeded)
+	assert.Equal(t, countFailedResults(results), 0)
+	var warnings []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	assert.Equal(t, warnings, []string{"Cannot find mount point /missing in the spec, skip"})
+	_, err := os.Stat(path.Join(outputDir, "missing-success"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_archiveUpperDirsParallel(t *testing.T) {
+	defer func() {
+		parallelism = 1
+	}()
+	parallelism = 3
+	outputDir := t.TempDir()
+	containerSpec := spec.Spec{Version: spec.Version}
+	archives := map[string]Archive{}
+	var wantNames []string
+	for i := 0; i < 8; i++ {
+		srcDir := t.TempDir()
+		err := os.WriteFile(path.Join(srcDir, "file.txt"), []byte(fmt.Sprintf("MOCK_CONTENT_%d", i)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("data%d", i)
+		mountPoint := "/" + name
+		containerSpec.Mounts = append(containerSpec.Mounts, spec.Mount{
+			Destination: mountPoint,
+			Source:      "/path/to/source",
+			Type:        "overlay",
+			Options:     []string{fmt.Sprintf("upperdir=%s", srcDir)},
+		})
+		archives[mountPoint] = Archive{
+			Name:       name,
+			MountPoint: mountPoint,
+			ArchiveTo:  path.Join(outputDir, name+".tar.gz"),
+			Method:     ArchiveMethodTarGzip,
+			TarUser:    -1,
+			TarGroup:   -1,
+		}
+		wantNames = append(wantNames, name)
+	}
+	results := archiveUpperDirs(spec.State{}, containerSpec, archives)
+	var names []string
+	for _, result := range results {
+		names = append(names, result.Name)
+		assert.Equal(t, result.Status, ArchiveStatusSucceeded)
+	}
+	// The results are in the order of mounts no matter which archive finishes first
+	assert.Equal(t, names, wantNames)
+
+	for i, name := range wantNames {
+		extractDir := t.TempDir()
+		extractTarGzip(t, path.Join(outputDir, name+".tar.gz"), extractDir)
+		content, err := os.ReadFile(path.Join(extractDir, "file.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, string(content), fmt.Sprintf("MOCK_CONTENT_%d", i))
+	}
+}
+
+func archiveSpecialFile(t *testing.T, makeFile func(filePath string) error) tar.Header {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	err := makeFile(path.Join(srcDir, "special"))
+	if err != nil {
+		t.Skipf("Cannot create special file with error %s", err)
+	}
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	_, err = archiveTarGzip(srcDir, outputFile, tarOptions{Uid: -1, Gid: -1}, 0, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readTarGzipHeaders(t, outputFile)["./special"]
+}
+
+func Test_archiveTarGzipSymlink(t *testing.T) {
+	header := archiveSpecialFile(t, func(filePath string) error {
+		return os.Symlink("../target.txt", filePath)
+	})
+	assert.Equal(t, header.Typeflag, byte(tar.TypeSymlink))
+	assert.Equal(t, header.Linkname, "../target.txt")
+}
+
+func Test_archiveTarGzipFifo(t *testing.T) {
+	// The FIFO is archived without being opened, which would block as nothing writes to it
+	header := archiveSpecialFile(t, func(filePath string) error {
+		return unix.Mkfifo(filePath, 0600)
+	})
+	assert.Equal(t, header.Typeflag, byte(tar.TypeFifo))
+	assert.Equal(t, header.Size, int64(0))
+}
+
+func Test_archiveTarGzipSocket(t *testing.T) {
+	header := archiveSpecialFile(t, func(filePath string) error {
+		return unix.Mknod(filePath, unix.S_IFSOCK|0600, 0)
+	})
+	assert.Equal(t, header, tar.Header{})
+}
+
+func Test_writeTarLogsArchiveName(t *testing.T) {
+	srcDir := t.TempDir()
+	err := unix.Mknod(path.Join(srcDir, "special"), unix.S_IFSOCK|0600, 0)
+	if err != nil {
+		t.Skipf("Cannot create socket file with error %s", err)
+	}
+	options := archiveTarOptions(Archive{Name: "data", TarUser: -1, TarGroup: -1}, false, nil)
+	assert.Equal(t, options.Logger.Data["archive"], "data")
+	logger, hook := logTest.NewNullLogger()
+	options.Logger = logger.WithFields(options.Logger.Data)
+	_, err = writeTar(srcDir, io.Discard, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The warnings of parallel archives tell which archive they are from
+	assert.Len(t, hook.Entries, 1)
+	assert.Equal(t, hook.LastEntry().Data["archive"], "data")
+	assert.Contains(t, hook.LastEntry().Message, "Skip archiving socket")
+}
+
+func Test_archiveTarGzipDevices(t *testing.T) {
+	header := archiveSpecialFile(t, func(filePath string) error {
+		return unix.Mknod(filePath, unix.S_IFCHR|0600, int(unix.Mkdev(1, 3)))
+	})
+	assert.Equal(t, header.Typeflag, byte(tar.TypeChar))
+	assert.Equal(t, header.Devmajor, int64(1))
+	assert.Equal(t, header.Devminor, int64(3))
+
+	header = archiveSpecialFile(t, func(filePath string) error {
+		return unix.Mknod(filePath, unix.S_IFBLK|0600, int(unix.Mkdev(7, 0)))
+	})
+	assert.Equal(t, header.Typeflag, byte(tar.TypeBlock))
+	assert.Equal(t, header.Devmajor, int64(7))
+	assert.Equal(t, header.Devminor, int64(0))
+}
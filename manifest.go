@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"time"
+)
+
+const (
+	SuccessFormatEmpty string = "empty"
+	SuccessFormatJSON         = "json"
+)
+
+var successFormats = []string{
+	SuccessFormatEmpty,
+	SuccessFormatJSON,
+}
+
+// archiveStats is the stats of an archive output
+type archiveStats struct {
+	// The number of files in the archive
+	Files int64
+	// The size in bytes of the archive file, or the total size of regular files for a folder output
+	Size int64
+	// The digest of the archive file, empty for a folder output
+	Digest digest.Digest
+}
+
+// ArchiveManifest is the content of the success file in json format
+type ArchiveManifest struct {
+	// The id of the container
+	ContainerID string
+	// The bundle path of the container
+	Bundle string
+	// The name of archive
+	Name string
+	// The "destination" filed of overlay mount point to get upperdir folder from
+	MountPoint string
+	// The upperdir folder archived
+	UpperDir string
+	// The archive method used
+	Method string
+	// The number of files in the archive
+	Files int64
+	// The size in bytes of the archive
+	Size int64
+	// The sha256 digest of the archive, the manifest digest for oci-image method
+	Digest digest.Digest `json:",omitempty"`
+	// The time archiving started
+	StartedAt time.Time
+	// The time archiving finished
+	FinishedAt time.Time
+	// The version of archive_overlay hook
+	HookVersion string
+}
+
+func newArchiveManifest(state spec.State, result ArchiveResult, stats archiveStats, startedAt time.Time, finishedAt time.Time) ArchiveManifest {
+	return ArchiveManifest{
+		ContainerID: state.ID,
+		Bundle:      state.Bundle,
+		Name:        result.Name,
+		MountPoint:  result.MountPoint,
+		UpperDir:    result.UpperDir,
+		Method:      result.Method,
+		Files:       stats.Files,
+		Size:        stats.Size,
+		Digest:      stats.Digest,
+		StartedAt:   startedAt,
+		FinishedAt:  finishedAt,
+		HookVersion: Version,
+	}
+}
+
+// writeArchiveSuccess writes the success file of the given archive in its success format, nothing is written if
+// the archive has no success file
+func writeArchiveSuccess(archive Archive, manifest ArchiveManifest) error {
+	if archive.ArchiveSuccess == "" {
+		return nil
+	}
+	var content []byte
+	if archive.SuccessFormat == SuccessFormatJSON {
+		var err error
+		content, err = json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+	}
+	err := writeFileAtomic(archive.ArchiveSuccess, content, 0644, archiveOutputOwnership(archive))
+	if err != nil {
+		return fmt.Errorf("failed to write archive success file %s with error %w", archive.ArchiveSuccess, err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_archiveUpperDirsManifest(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	err := os.WriteFile(path.Join(srcDir, "file.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archiveTo := path.Join(outputDir, "data.tar.gz")
+	successFile := path.Join(outputDir, "success.json")
+	containerSpec := spec.Spec{
+		Version: spec.Version,
+		Mounts: []spec.Mount{
+			{
+				Destination: "/data",
+				Source:      "/path/to/source",
+				Type:        "overlay",
+				Options: []string{
+					"lowerdir=/path/to/lower",
+					fmt.Sprintf("upperdir=%s", srcDir),
+					"workdir=/path/to/work",
+				},
+			},
+		},
+	}
+	archives := map[string]Archive{
+		"/data": {
+			Name:           "data",
+			MountPoint:     "/data",
+			ArchiveTo:      archiveTo,
+			ArchiveSuccess: successFile,
+			SuccessFormat:  SuccessFormatJSON,
+			Method:         ArchiveMethodTarGzip,
+			TarUser:        -1,
+			TarGroup:       -1,
+		},
+	}
+	state := spec.State{ID: "mock-container", Bundle: "/path/to/bundle"}
+	results := archiveUpperDirs(state, containerSpec, archives)
+	assert.Equal(t, results[0].Status, ArchiveStatusSucceeded)
+
+	content, err := os.ReadFile(successFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ArchiveManifest
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiveContent, err := os.ReadFile(archiveTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, manifest.ContainerID, "mock-container")
+	assert.Equal(t, manifest.Bundle, "/path/to/bundle")
+	assert.Equal(t, manifest.Name, "data")
+	assert.Equal(t, manifest.MountPoint, "/data")
+	assert.Equal(t, manifest.UpperDir, srcDir)
+	assert.Equal(t, manifest.Method, ArchiveMethodTarGzip)
+	// The upperdir itself and the file in it
+	assert.Equal(t, manifest.Files, int64(2))
+	assert.Equal(t, manifest.Size, int64(len(archiveContent)))
+	assert.Equal(t, manifest.Digest, digest.FromBytes(archiveContent))
+	assert.False(t, manifest.FinishedAt.Before(manifest.StartedAt))
+	assert.Equal(t, manifest.HookVersion, Version)
+}
+
+func Test_writeArchiveSuccessEmpty(t *testing.T) {
+	outputDir := t.TempDir()
+	successFile := path.Join(outputDir, "success")
+	err := writeArchiveSuccess(Archive{ArchiveSuccess: successFile}, ArchiveManifest{Name: "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(successFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, content)
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No temp file is left behind
+	assert.Equal(t, len(entries), 1)
+}
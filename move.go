@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The annotation podman sets for the containers created with --rm option
+// ref: https://github.com/containers/podman/blob/v4.5.1/libpod/define/annotations.go
+const podmanAutoRemoveAnnotation = "io.podman.annotations.autoremove"
+
+// isAutoRemove returns true if the container is marked for removal after it exits
+func isAutoRemove(annotations map[string]string) bool {
+	return strings.EqualFold(annotations[podmanAutoRemoveAnnotation], "true")
+}
+
+// archiveMove moves the content of the upperdir into archiveTo. The files are renamed into a temp folder next to
+// archiveTo, or copied and then deleted from the upperdir if they are on different filesystems, then the temp folder
+// is renamed to archiveTo with the output ownership set. The renamed files are moved back to the upperdir if anything
+// goes wrong before that, and the temp folder is left behind if any of them cannot be moved back. Once the files are
+// in archiveTo, failing to set the ownership of the renamed files is only logged as the archive is done already.
+func archiveMove(upperDir string, archiveTo string, options copyOptions, output outputOwnership) (archiveStats, error) {
+	upperDirInfo, err := os.Stat(upperDir)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	if options.Quota != (archiveQuota{}) {
+		// The renamed files don't go through the quota counter of copyTree, so the upperdir is checked as a whole
+		// before anything is moved
+		upperDirStats, err := dirStats(upperDir)
+		if err != nil {
+			return archiveStats{}, err
+		}
+		err = options.Quota.Check(upperDirStats)
+		if err != nil {
+			return archiveStats{}, err
+		}
+	}
+	entries, err := os.ReadDir(upperDir)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	stageDir, err := createTempDir(archiveTo)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	keepStageDir := false
+	defer func() {
+		if keepStageDir {
+			options.logger().Errorf("Leave temp folder %s behind to keep the files of upperdir %s in it", filepath.Join(filepath.Dir(archiveTo), stageDir.tempName), upperDir)
+			stageDir.Close()
+			return
+		}
+		stageDir.Discard()
+	}()
+
+	var moved []string
+	fail := func(err error) (archiveStats, error) {
+		for _, name := range moved {
+			restoreErr := os.Rename(filepath.Join(stageDir.Path, name), filepath.Join(upperDir, name))
+			if restoreErr != nil {
+				options.logger().Errorf("Failed to move %s back to upperdir %s with error %s", name, upperDir, restoreErr)
+				keepStageDir = true
+			}
+		}
+		return archiveStats{}, err
+	}
+	crossDevice := false
+	for _, entry := range entries {
+		err = os.Rename(filepath.Join(upperDir, entry.Name()), filepath.Join(stageDir.Path, entry.Name()))
+		if errors.Is(err, unix.EXDEV) && len(moved) == 0 {
+			crossDevice = true
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		moved = append(moved, entry.Name())
+	}
+	if crossDevice {
+		options.logger().Infof("Upperdir %s and %s are on different filesystems, copy and delete instead", upperDir, archiveTo)
+		err = copyTree(upperDir, stageDir.Path, options)
+		if err == nil {
+			// The copies are not in the upperdir, so they can be chowned before committing
+			err = output.applyTree(stageDir.Path)
+		}
+	} else {
+		err = os.Chmod(stageDir.Path, upperDirInfo.Mode())
+	}
+	if err != nil {
+		return fail(err)
+	}
+	stats, err := dirStats(stageDir.Path)
+	if err != nil {
+		return fail(err)
+	}
+	committed, err := stageDir.Commit()
+	if err != nil {
+		if committed {
+			revertErr := stageDir.Revert()
+			if revertErr != nil {
+				// The files are in archiveTo already, and the temp folder may have the old content
+				keepStageDir = true
+				return archiveStats{}, fmt.Errorf("%w, and failed to revert with error %s", err, revertErr)
+			}
+		}
+		return fail(err)
+	}
+	if !crossDevice {
+		// The renamed files are chowned only once committed, so that the ones moved back to the upperdir keep their
+		// owners
+		if options.IDMap != nil {
+			err = options.IDMap.chownTreeToContainer(stageDir.Path)
+			if err != nil {
+				options.logger().Warnf("Failed to chown moved files in %s with error %s", archiveTo, err)
+			}
+		}
+		err = output.applyTree(stageDir.Path)
+		if err != nil {
+			options.logger().Warnf("Failed to apply output ownership to %s with error %s", archiveTo, err)
+		}
+	}
+	if crossDevice {
+		for _, entry := range entries {
+			err = os.RemoveAll(filepath.Join(upperDir, entry.Name()))
+			if err != nil {
+				return stats, fmt.Errorf("failed to delete %s from upperdir after copying with error %w", entry.Name(), err)
+			}
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	logTest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+// The upperdir content the move and destination tests archive
+var mockMoveTree = map[string]string{"nested/file.txt": "MOCK_CONTENT"}
+
+func assertMoved(t *testing.T, srcDir string, archiveTo string) {
+	content, err := os.ReadFile(path.Join(archiveTo, "nested", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "MOCK_CONTENT")
+	// The upperdir itself is kept with nothing left in it
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, entries)
+}
+
+func Test_archiveMove(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockMoveTree)
+	archiveTo := path.Join(outputDir, "archive")
+	stats, err := archiveMove(srcDir, archiveTo, copyOptions{}, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, stats, archiveStats{Files: 3, Size: 12})
+	assertMoved(t, srcDir, archiveTo)
+}
+
+func Test_archiveMoveCrossDevice(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir, err := os.MkdirTemp("/dev/shm", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeTree(t, srcDir, mockMoveTree)
+	var srcStat, outputStat syscall.Stat_t
+	if syscall.Stat(srcDir, &srcStat) != nil || syscall.Stat(outputDir, &outputStat) != nil || srcStat.Dev == outputStat.Dev {
+		t.Skip("No different filesystems to move across")
+	}
+	archiveTo := path.Join(outputDir, "archive")
+	_, err = archiveMove(srcDir, archiveTo, copyOptions{}, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMoved(t, srcDir, archiveTo)
+}
+
+func Test_archiveMoveFailure(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockMoveTree)
+	// A file in the way of archive-to fails the move
+	archiveTo := path.Join(outputDir, "file", "archive")
+	err := os.WriteFile(path.Join(outputDir, "file"), []byte{}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = archiveMove(srcDir, archiveTo, copyOptions{}, outputOwnership{})
+	assert.NotNil(t, err)
+	// The upperdir is left as it is
+	content, err := os.ReadFile(path.Join(srcDir, "nested", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "MOCK_CONTENT")
+}
+
+func Test_archiveMoveQuotaExceeded(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockMoveTree)
+	for _, quota := range []archiveQuota{{MaxSize: 11}, {MaxFiles: 2}} {
+		archiveTo := path.Join(t.TempDir(), "archive")
+		_, err := archiveMove(srcDir, archiveTo, copyOptions{Quota: quota}, outputOwnership{})
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+		// Nothing is moved out of the upperdir
+		content, err := os.ReadFile(path.Join(srcDir, "nested", "file.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, string(content), "MOCK_CONTENT")
+		_, err = os.Stat(archiveTo)
+		assert.True(t, os.IsNotExist(err))
+	}
+	archiveTo := path.Join(t.TempDir(), "archive")
+	_, err := archiveMove(srcDir, archiveTo, copyOptions{Quota: archiveQuota{MaxSize: 12, MaxFiles: 3}}, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMoved(t, srcDir, archiveTo)
+}
+
+func Test_archiveMoveOwnershipFailure(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("Chown to root cannot fail for root")
+	}
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockMoveTree)
+	archiveTo := path.Join(t.TempDir(), "archive")
+	uid := 0
+	logger, hook := logTest.NewNullLogger()
+	// The files are in archiveTo already when chowning them fails, so the archive still succeeds
+	stats, err := archiveMove(srcDir, archiveTo, copyOptions{Logger: logger.WithField("archive", "data")}, outputOwnership{Uid: &uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, stats.Files, int64(3))
+	assertMoved(t, srcDir, archiveTo)
+	assert.Equal(t, hook.LastEntry().Level, log.WarnLevel)
+	assert.Contains(t, hook.LastEntry().Message, "Failed to apply output ownership")
+}
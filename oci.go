@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+type ociLayer struct {
+	// The descriptor of the compressed layer blob
+	Descriptor ocispec.Descriptor
+	// The digest of the uncompressed layer tar
+	DiffID digest.Digest
+	// The number of entries in the layer tar
+	Entries int64
+}
+
+type countingWriter struct {
+	Size int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.Size += int64(len(p))
+	return len(p), nil
+}
+
+// writeOCIBlob writes the given content as a blob into the OCI image layout and returns its descriptor
+func writeOCIBlob(layoutDir string, mediaType string, content []byte) (ocispec.Descriptor, error) {
+	blobDigest := digest.FromBytes(content)
+	blobPath := filepath.Join(layoutDir, ocispec.ImageBlobsDir, blobDigest.Algorithm().String(), blobDigest.Encoded())
+	err := os.WriteFile(blobPath, content, 0644)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      int64(len(content)),
+	}, nil
+}
+
+// writeOCILayerBlob archives the given folder as a gzip compressed layer blob into the OCI image layout
+func writeOCILayerBlob(layoutDir string, src string, options tarOptions) (ociLayer, error) {
+	blobsDir := filepath.Join(layoutDir, ocispec.ImageBlobsDir, digest.Canonical.String())
+	blobFile, err := os.CreateTemp(blobsDir, ".layer-*")
+	if err != nil {
+		return ociLayer{}, err
+	}
+	defer os.Remove(blobFile.Name())
+	defer blobFile.Close()
+
+	blobDigester := digest.Canonical.Digester()
+	blobCounter := &countingWriter{}
+	gzipWriter := pgzip.NewWriter(io.MultiWriter(blobFile, blobDigester.Hash(), blobCounter))
+	defer gzipWriter.Close()
+	diffIDDigester := digest.Canonical.Digester()
+	entries, err := writeTar(src, io.MultiWriter(gzipWriter, diffIDDigester.Hash()), options)
+	if err != nil {
+		return ociLayer{}, err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return ociLayer{}, err
+	}
+	err = blobFile.Close()
+	if err != nil {
+		return ociLayer{}, err
+	}
+	blobDigest := blobDigester.Digest()
+	err = os.Rename(blobFile.Name(), filepath.Join(blobsDir, blobDigest.Encoded()))
+	if err != nil {
+		return ociLayer{}, err
+	}
+	return ociLayer{
+		Descriptor: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    blobDigest,
+			Size:      blobCounter.Size,
+		},
+		DiffID:  diffIDDigester.Digest(),
+		Entries: entries,
+	}, nil
+}
+
+// archiveOCIImage writes an OCI image layout with the given lower dirs (from bottom to top) as the base layers
+// and the upper dir as the top layer, the base layers are archived from the lower dirs again, so they don't match the
+// original layers of the image. The digest of the stats is the manifest digest, and the files are the ones of the
+// upper dir only, same as the other methods.
+func archiveOCIImage(lowerDirs []string, upperDir string, archiveTo string, refName string, options tarOptions) (archiveStats, error) {
+	if len(lowerDirs) == 0 {
+		return archiveStats{}, fmt.Errorf("no lowerdirs found for the base layers of the image")
+	}
+	err := os.MkdirAll(filepath.Join(archiveTo, ocispec.ImageBlobsDir, digest.Canonical.String()), 0755)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	var stats archiveStats
+
+	created := time.Now().UTC()
+	var layers []ocispec.Descriptor
+	config := ocispec.Image{
+		Created: &created,
+		Platform: ocispec.Platform{
+			Architecture: runtime.GOARCH,
+			OS:           "linux",
+		},
+		RootFS: ocispec.RootFS{Type: "layers"},
+	}
+	addLayer := func(src string, layerOptions tarOptions, comment string) (ociLayer, error) {
+		layer, err := writeOCILayerBlob(archiveTo, src, layerOptions)
+		if err != nil {
+			return layer, fmt.Errorf("failed to write layer from %s with error %w", src, err)
+		}
+		layers = append(layers, layer.Descriptor)
+		stats.Size += layer.Descriptor.Size
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.DiffID)
+		config.History = append(config.History, ocispec.History{Created: &created, Comment: comment})
+		return layer, nil
+	}
+	for _, lowerDir := range lowerDirs {
+		// The lower layers come from the mounted image, keep their content owners as they are, except for mapping
+		// them into the container the same way as the upper layer
+		_, err = addLayer(lowerDir, tarOptions{Uid: -1, Gid: -1, ConvertWhiteouts: true, IDMap: options.IDMap, Logger: options.Logger}, "")
+		if err != nil {
+			return archiveStats{}, err
+		}
+	}
+	upperOptions := options
+	upperOptions.ConvertWhiteouts = true
+	upperLayer, err := addLayer(upperDir, upperOptions, "upperdir archived by archive_overlay "+Version)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	stats.Files = upperLayer.Entries
+
+	configContent, err := json.Marshal(config)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	configDescriptor, err := writeOCIBlob(archiveTo, ocispec.MediaTypeImageConfig, configContent)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	manifestContent, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDescriptor,
+		Layers:    layers,
+	})
+	if err != nil {
+		return archiveStats{}, err
+	}
+	manifestDescriptor, err := writeOCIBlob(archiveTo, ocispec.MediaTypeImageManifest, manifestContent)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	manifestDescriptor.Annotations = map[string]string{ocispec.AnnotationRefName: refName}
+	manifestDescriptor.Platform = &config.Platform
+
+	indexContent, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{manifestDescriptor},
+	})
+	if err != nil {
+		return archiveStats{}, err
+	}
+	err = os.WriteFile(filepath.Join(archiveTo, ocispec.ImageIndexFile), indexContent, 0644)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	layoutContent, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return archiveStats{}, err
+	}
+	err = os.WriteFile(filepath.Join(archiveTo, ocispec.ImageLayoutFile), layoutContent, 0644)
+	if err != nil {
+		return archiveStats{}, err
+	}
+	stats.Size += configDescriptor.Size + manifestDescriptor.Size
+	stats.Digest = manifestDescriptor.Digest
+	return stats, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func readOCIBlob(t *testing.T, layoutDir string, descriptor ocispec.Descriptor) []byte {
+	content, err := os.ReadFile(path.Join(layoutDir, "blobs", descriptor.Digest.Algorithm().String(), descriptor.Digest.Encoded()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, descriptor.Digest, digest.FromBytes(content))
+	assert.Equal(t, descriptor.Size, int64(len(content)))
+	return content
+}
+
+func Test_archiveOCIImage(t *testing.T) {
+	outputDir := t.TempDir()
+	lowerDir := t.TempDir()
+	upperDir := t.TempDir()
+	err := os.WriteFile(path.Join(lowerDir, "base.txt"), []byte("BASE"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(upperDir, "file.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layoutDir := path.Join(outputDir, "image")
+	stats, err := archiveOCIImage([]string{lowerDir}, upperDir, layoutDir, "data", tarOptions{Uid: 2000, Gid: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the upperdir root and the file in it are counted
+	assert.Equal(t, stats.Files, int64(2))
+
+	// The image is not written without its base layers
+	_, err = archiveOCIImage(nil, upperDir, path.Join(outputDir, "no-base"), "data", tarOptions{Uid: 2000, Gid: 3000})
+	assert.ErrorContains(t, err, "no lowerdirs")
+
+	layoutContent, err := os.ReadFile(path.Join(layoutDir, "oci-layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layout ocispec.ImageLayout
+	err = json.Unmarshal(layoutContent, &layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, layout.Version, ocispec.ImageLayoutVersion)
+
+	indexContent, err := os.ReadFile(path.Join(layoutDir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index ocispec.Index
+	err = json.Unmarshal(indexContent, &index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, index.Manifests, 1)
+	assert.Equal(t, index.Manifests[0].Annotations[ocispec.AnnotationRefName], "data")
+
+	var manifest ocispec.Manifest
+	err = json.Unmarshal(readOCIBlob(t, layoutDir, index.Manifests[0]), &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ocispec.Image
+	err = json.Unmarshal(readOCIBlob(t, layoutDir, manifest.Config), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, manifest.Layers, 2)
+	assert.Len(t, config.RootFS.DiffIDs, 2)
+	// No host path shows up in the history
+	assert.Len(t, config.History, 2)
+	for _, history := range config.History {
+		assert.NotContains(t, history.Comment, lowerDir)
+	}
+	for i, layer := range manifest.Layers {
+		assert.Equal(t, layer.MediaType, ocispec.MediaTypeImageLayerGzip)
+		readOCIBlob(t, layoutDir, layer)
+		blobFile, err := os.Open(path.Join(layoutDir, "blobs", "sha256", layer.Digest.Encoded()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gzipReader, err := gzip.NewReader(blobFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffIDDigester := digest.Canonical.Digester()
+		_, err = io.Copy(diffIDDigester.Hash(), gzipReader)
+		blobFile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, config.RootFS.DiffIDs[i], diffIDDigester.Digest())
+	}
+}
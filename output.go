@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// tempPattern returns the pattern of temp files or folders next to the given path, they are hidden and named after
+// the path to make it easy to tell where the leftovers come from
+func tempPattern(path string) string {
+	return "." + filepath.Base(path) + ".tmp-*"
+}
+
+// syncDir fsyncs the given folder, it makes the renames in the folder durable
+func syncDir(dir string) error {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+// syncTree fsyncs all the regular files and folders in the given folder
+func syncTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return file.Sync()
+	})
+}
+
+// outputOwnership is the owner and mode to set for the archive outputs
+type outputOwnership struct {
+	// The user (uid) to chown the outputs to, nil means keeping it unchanged
+	Uid *int
+	// The group (gid) to chown the outputs to, nil means keeping it unchanged
+	Gid *int
+	// The permission bits to set for the archive file or folder and the success file, zero means keeping the default
+	Mode os.FileMode
+}
+
+// archiveOutputOwnership returns the output ownership of the given archive
+func archiveOutputOwnership(archive Archive) outputOwnership {
+	return outputOwnership{Uid: archive.OutputUser, Gid: archive.OutputGroup, Mode: archive.OutputMode}
+}
+
+// idOrUnchanged returns the given uid or gid, or -1 for chown to keep it unchanged if it's nil
+func idOrUnchanged(id *int) int {
+	if id == nil {
+		return -1
+	}
+	return *id
+}
+
+// applyFile sets the owner and mode of the given output file
+func (o outputOwnership) applyFile(file *os.File) error {
+	if o.Uid != nil || o.Gid != nil {
+		uid, gid := idOrUnchanged(o.Uid), idOrUnchanged(o.Gid)
+		err := file.Chown(uid, gid)
+		if err != nil {
+			return fmt.Errorf("failed to chown %s to %d:%d with error %w", file.Name(), uid, gid, err)
+		}
+	}
+	if o.Mode != 0 {
+		return file.Chmod(o.Mode)
+	}
+	return nil
+}
+
+// applyTree sets the owner of everything in the given output folder, symlinks themselves instead of their targets,
+// and the mode of the folder itself
+func (o outputOwnership) applyTree(dir string) error {
+	if o.Uid != nil || o.Gid != nil {
+		uid, gid := idOrUnchanged(o.Uid), idOrUnchanged(o.Gid)
+		err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, uid, gid)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to chown output folder to %d:%d with error %w", uid, gid, err)
+		}
+	}
+	if o.Mode != 0 {
+		return os.Chmod(dir, o.Mode)
+	}
+	return nil
+}
+
+// tempFile is a temp file created next to an output path to be committed to it later, the parent folder is opened
+// without following symlinks and the files are created and renamed relative to it
+type tempFile struct {
+	*os.File
+	// The opened parent folder of the output path
+	dir *os.File
+	// The name of the temp file in the parent folder
+	tempName string
+	// The name of the output path in the parent folder
+	name string
+}
+
+// createTempFile creates a temp file next to the given path to be committed with Commit later
+func createTempFile(path string, perm os.FileMode) (*tempFile, error) {
+	dir, err := openDestDir(path, false)
+	if err != nil {
+		return nil, err
+	}
+	var file *os.File
+	tempName, err := createBeneath(tempPattern(path), func(name string) error {
+		fd, err := openBeneath(int(dir.Fd()), name, unix.O_RDWR|unix.O_CREAT|unix.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		file = os.NewFile(uintptr(fd), procFdPath(dir, name))
+		return nil
+	})
+	if err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("failed to create temp file for %s with error %w", path, err)
+	}
+	temp := &tempFile{File: file, dir: dir, tempName: tempName, name: filepath.Base(path)}
+	// Chmod after creating, so that the mode is not affected by umask
+	err = file.Chmod(perm)
+	if err != nil {
+		temp.Discard()
+		return nil, err
+	}
+	return temp, nil
+}
+
+// Commit syncs and closes the temp file, then renames it to the output path
+func (f *tempFile) Commit() error {
+	err := f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	// The rename replaces a symlink at the output path instead of following it
+	err = unix.Renameat(int(f.dir.Fd()), f.tempName, int(f.dir.Fd()), f.name)
+	if err != nil {
+		return fmt.Errorf("failed to rename temp file to %s with error %w", f.name, err)
+	}
+	return f.dir.Sync()
+}
+
+// Discard closes the temp file and its parent folder, and removes the temp file if it's not committed
+func (f *tempFile) Discard() {
+	f.Close()
+	unix.Unlinkat(int(f.dir.Fd()), f.tempName, 0)
+	f.dir.Close()
+}
+
+// writeFileAtomic writes the content into a temp file next to the given path, syncs and renames it to the path, so
+// that readers never see a partially written file
+func writeFileAtomic(path string, content []byte, perm os.FileMode, output outputOwnership) error {
+	tempFile, err := createTempFile(path, perm)
+	if err != nil {
+		return err
+	}
+	defer tempFile.Discard()
+	_, err = tempFile.Write(content)
+	if err != nil {
+		return err
+	}
+	err = output.applyFile(tempFile.File)
+	if err != nil {
+		return err
+	}
+	return tempFile.Commit()
+}
+
+// tempDir is a temp folder created next to an output path to be committed to it later, the parent folder is opened
+// without following symlinks and the folders are created and renamed relative to it
+type tempDir struct {
+	// The path to write the content of the temp folder into, it's under the /proc/self/fd path of the parent folder
+	Path string
+	// The opened parent folder of the output path
+	dir *os.File
+	// The name of the temp folder in the parent folder
+	tempName string
+	// The name of the output path in the parent folder
+	name string
+	// Whether the temp folder has been renamed to the output path
+	committed bool
+	// Whether the temp folder was exchanged with an existing folder at the output path
+	exchanged bool
+}
+
+// createTempDir creates a temp folder next to the given path to be committed with Commit later, the parent folders
+// are created if they don't exist
+func createTempDir(path string) (*tempDir, error) {
+	dir, err := openDestDir(path, true)
+	if err != nil {
+		return nil, err
+	}
+	tempName, err := createBeneath(tempPattern(path), func(name string) error {
+		return unix.Mkdirat(int(dir.Fd()), name, 0700)
+	})
+	if err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("failed to create temp folder for %s with error %w", path, err)
+	}
+	temp := &tempDir{Path: procFdPath(dir, tempName), dir: dir, tempName: tempName, name: filepath.Base(path)}
+	fd, err := openBeneath(int(dir.Fd()), tempName, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		temp.Discard()
+		return nil, err
+	}
+	defer unix.Close(fd)
+	// Mkdirat creates the folder with 0700
+	err = unix.Fchmod(fd, 0755)
+	if err != nil {
+		temp.Discard()
+		return nil, err
+	}
+	return temp, nil
+}
+
+// Commit syncs the temp folder and renames it to the output path, Path points to the output path afterward. An
+// existing folder at the path is swapped out atomically and removed by Discard, so that readers see either the old
+// folder or the new one as a whole. It reports whether the temp folder has been renamed, even if it fails after that.
+func (d *tempDir) Commit() (bool, error) {
+	err := syncTree(d.Path)
+	if err != nil {
+		return false, err
+	}
+	dirFd := int(d.dir.Fd())
+	err = unix.Renameat2(dirFd, d.tempName, dirFd, d.name, unix.RENAME_EXCHANGE)
+	if errors.Is(err, unix.ENOENT) {
+		err = unix.Renameat(dirFd, d.tempName, dirFd, d.name)
+		if err != nil {
+			return false, fmt.Errorf("failed to rename temp folder to %s with error %w", d.name, err)
+		}
+	} else if err != nil {
+		return false, fmt.Errorf("failed to exchange temp folder with %s with error %w", d.name, err)
+	} else {
+		d.exchanged = true
+	}
+	d.committed = true
+	d.Path = procFdPath(d.dir, d.name)
+	return true, d.dir.Sync()
+}
+
+// Revert undoes Commit before Discard, the temp folder is renamed back and the old folder is put back to the output
+// path if they were exchanged
+func (d *tempDir) Revert() error {
+	if !d.committed {
+		return nil
+	}
+	dirFd := int(d.dir.Fd())
+	var err error
+	if d.exchanged {
+		err = unix.Renameat2(dirFd, d.tempName, dirFd, d.name, unix.RENAME_EXCHANGE)
+	} else {
+		err = unix.Renameat(dirFd, d.name, dirFd, d.tempName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to revert %s to temp folder with error %w", d.name, err)
+	}
+	d.committed = false
+	d.exchanged = false
+	d.Path = procFdPath(d.dir, d.tempName)
+	return nil
+}
+
+// Close closes the parent folder and leaves the temp folder behind
+func (d *tempDir) Close() {
+	d.dir.Close()
+}
+
+// Discard closes the parent folder, and removes the temp folder, which has the old content of the output path if it
+// was exchanged by Commit
+func (d *tempDir) Discard() {
+	os.RemoveAll(procFdPath(d.dir, d.tempName))
+	d.dir.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func Test_archiveTarGzipOverwrite(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	err := os.WriteFile(path.Join(srcDir, "file.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	// An older and larger archive is at the path already
+	err = os.WriteFile(outputFile, make([]byte, 1024*1024), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := archiveTarGzip(srcDir, outputFile, tarOptions{Uid: -1, Gid: -1}, 0, outputOwnership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Stat(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fileInfo.Size(), stats.Size)
+	assert.Equal(t, fileInfo.Mode().Perm(), os.FileMode(0644))
+	extractDir := t.TempDir()
+	extractTarGzip(t, outputFile, extractDir)
+	content, err := os.ReadFile(path.Join(extractDir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "MOCK_CONTENT")
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(entries), 1)
+}
+
+func Test_archiveTarGzipFailure(t *testing.T) {
+	outputDir := t.TempDir()
+	outputFile := path.Join(outputDir, "output.tar.gz")
+	_, err := archiveTarGzip(path.Join(outputDir, "missing"), outputFile, tarOptions{Uid: -1, Gid: -1}, 0, outputOwnership{})
+	assert.NotNil(t, err)
+
+	// Neither the archive nor the temp file is left behind
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, entries)
+}
+
+func Test_archiveDirReplace(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, map[string]string{"new.txt": "NEW"})
+	archiveTo := path.Join(outputDir, "nested", "archive")
+	writeTree(t, archiveTo, map[string]string{"old.txt": "OLD"})
+
+	stats, err := archiveUpperDir(Archive{Name: "data", ArchiveTo: archiveTo}, srcDir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, stats, archiveStats{Files: 2, Size: 3})
+	content, err := os.ReadFile(path.Join(archiveTo, "new.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "NEW")
+	// The old folder is replaced as a whole instead of being merged into
+	_, err = os.Stat(path.Join(archiveTo, "old.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := os.ReadDir(path.Join(outputDir, "nested"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(entries), 1)
+}
+
+func Test_archiveDirFailure(t *testing.T) {
+	outputDir := t.TempDir()
+	archiveTo := path.Join(outputDir, "archive")
+	_, err := archiveUpperDir(Archive{Name: "data", ArchiveTo: archiveTo}, path.Join(outputDir, "missing"), nil, nil)
+	assert.NotNil(t, err)
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, entries)
+}
+
+func Test_archiveUpperDirOutputOwnership(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Chown to other users requires root")
+	}
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockMoveTree)
+	err := os.Symlink("file.txt", path.Join(srcDir, "nested", "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOwnership := func(filePath string, mode os.FileMode) {
+		fileInfo, err := os.Lstat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := fileInfo.Sys().(*syscall.Stat_t)
+		assert.Equal(t, stat.Uid, uint32(2000), filePath)
+		assert.Equal(t, stat.Gid, uint32(3000), filePath)
+		if mode != 0 {
+			assert.Equal(t, fileInfo.Mode().Perm(), mode, filePath)
+		}
+	}
+	outputUser, outputGroup := 2000, 3000
+	for _, method := range []string{ArchiveMethodCopy, ArchiveMethodTarGzip} {
+		archive := Archive{
+			Name:           "data",
+			ArchiveTo:      path.Join(outputDir, method),
+			ArchiveSuccess: path.Join(outputDir, method+".success"),
+			Method:         method,
+			TarUser:        -1,
+			TarGroup:       -1,
+			OutputUser:     &outputUser,
+			OutputGroup:    &outputGroup,
+			OutputMode:     0750,
+		}
+		_, err = archiveUpperDir(archive, srcDir, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writeArchiveSuccess(archive, ArchiveManifest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOwnership(archive.ArchiveTo, 0750)
+		assertOwnership(archive.ArchiveSuccess, 0750)
+	}
+	// Everything in the copied folder is chowned, while only the folder itself gets the mode
+	assertOwnership(path.Join(outputDir, ArchiveMethodCopy, "nested"), 0755)
+	assertOwnership(path.Join(outputDir, ArchiveMethodCopy, "nested", "file.txt"), 0644)
+	assertOwnership(path.Join(outputDir, ArchiveMethodCopy, "nested", "link.txt"), 0)
+}
+
+func Test_tempDirRevert(t *testing.T) {
+	archiveTo := path.Join(t.TempDir(), "archive")
+	for _, exists := range []bool{true, false} {
+		if exists {
+			writeTree(t, archiveTo, map[string]string{"old.txt": "OLD"})
+		}
+		stageDir, err := createTempDir(archiveTo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTree(t, stageDir.Path, map[string]string{"new.txt": "NEW"})
+		// Revert before Commit does nothing
+		assert.Nil(t, stageDir.Revert())
+		committed, err := stageDir.Commit()
+		assert.True(t, committed)
+		assert.Nil(t, err)
+		assert.Nil(t, stageDir.Revert())
+
+		// The new content is back in the temp folder, and the old one at archive-to
+		content, err := os.ReadFile(path.Join(stageDir.Path, "new.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, string(content), "NEW")
+		content, err = os.ReadFile(path.Join(archiveTo, "old.txt"))
+		if exists {
+			assert.Equal(t, string(content), "OLD")
+		} else {
+			assert.True(t, os.IsNotExist(err))
+		}
+		stageDir.Discard()
+		os.RemoveAll(archiveTo)
+	}
+}
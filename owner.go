@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	passwdPath = "etc/passwd"
+	groupPath  = "etc/group"
+)
+
+var errNameNotFound = errors.New("name not found")
+
+// ownerSpec is the user and group of an owner argument, each of them is given either by id or by name
+type ownerSpec struct {
+	Uid int
+	Gid int
+	// The user name to look up the uid from, empty if the uid is given
+	User string
+	// The group name to look up the gid from, empty if the gid is given
+	Group string
+}
+
+// containerRootfs returns the path to the root filesystem of the container, a relative root path in the spec is
+// relative to the bundle
+func containerRootfs(bundle string, containerSpec spec.Spec) (string, error) {
+	if containerSpec.Root == nil || containerSpec.Root.Path == "" {
+		return "", fmt.Errorf("no root path in the spec")
+	}
+	if filepath.IsAbs(containerSpec.Root.Path) {
+		return containerSpec.Root.Path, nil
+	}
+	return filepath.Join(bundle, containerSpec.Root.Path), nil
+}
+
+// openInRoot opens the file at the relative path with symlinks resolved as if the root folder was "/", so that a
+// symlink in the container cannot lead to a file on the host. Symlinks are refused instead if openat2 is not
+// supported.
+func openInRoot(root string, path string) (*os.File, error) {
+	rootDir, err := os.OpenFile(root, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rootDir.Close()
+	fd, err := unix.Openat2(int(rootDir.Fd()), path, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if errors.Is(err, unix.ENOSYS) {
+		dirFd := int(rootDir.Fd())
+		names := strings.Split(path, "/")
+		for i, name := range names {
+			flags := unix.O_RDONLY
+			if i < len(names)-1 {
+				flags |= unix.O_DIRECTORY
+			}
+			fd, err = openatNoFollow(dirFd, name, flags, 0)
+			if dirFd != int(rootDir.Fd()) {
+				unix.Close(dirFd)
+			}
+			if err != nil {
+				break
+			}
+			dirFd = fd
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s in %s with error %w", path, root, err)
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(root, path)), nil
+}
+
+// lookupDatabaseID looks up the id of the name in the passwd or group formatted file at the path in the root
+// folder, both of them have the name in the first field and the id in the third one
+func lookupDatabaseID(root string, path string, name string) (int, error) {
+	file, err := openInRoot(root, path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid id %s of %s in %s with error %w", fields[2], name, file.Name(), err)
+		}
+		return id, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read %s with error %w", file.Name(), err)
+	}
+	return 0, fmt.Errorf("cannot find %s in %s: %w", name, file.Name(), errNameNotFound)
+}
+
+// lookupUserID looks up the uid of the user name in the container rootfs, then in the host if the host fallback
+// is enabled
+func lookupUserID(rootfs string, name string) (int, error) {
+	uid, err := lookupDatabaseID(rootfs, passwdPath, name)
+	if err == nil || !ownerHostFallback {
+		return uid, err
+	}
+	log.Debugf("Cannot find user %s in the container with error %s, look it up in the host instead", name, err)
+	hostUser, hostErr := user.Lookup(name)
+	if hostErr != nil {
+		return 0, fmt.Errorf("%w, and failed to look it up in the host with error %s", err, hostErr)
+	}
+	return strconv.Atoi(hostUser.Uid)
+}
+
+// lookupGroupID looks up the gid of the group name in the container rootfs, then in the host if the host fallback
+// is enabled
+func lookupGroupID(rootfs string, name string) (int, error) {
+	gid, err := lookupDatabaseID(rootfs, groupPath, name)
+	if err == nil || !ownerHostFallback {
+		return gid, err
+	}
+	log.Debugf("Cannot find group %s in the container with error %s, look it up in the host instead", name, err)
+	hostGroup, hostErr := user.LookupGroup(name)
+	if hostErr != nil {
+		return 0, fmt.Errorf("%w, and failed to look it up in the host with error %s", err, hostErr)
+	}
+	return strconv.Atoi(hostGroup.Gid)
+}
+
+// resolveTarOwner returns the archive with the user and group names of the tar content owner resolved into ids
+// with the databases in the container rootfs
+func resolveTarOwner(archive Archive, bundle string, containerSpec spec.Spec) (Archive, error) {
+	if archive.TarUserName == "" && archive.TarGroupName == "" {
+		return archive, nil
+	}
+	rootfs, err := containerRootfs(bundle, containerSpec)
+	if err != nil {
+		return archive, fmt.Errorf("failed to find container rootfs for tar content owner with error %w", err)
+	}
+	if archive.TarUserName != "" {
+		uid, err := lookupUserID(rootfs, archive.TarUserName)
+		if err != nil {
+			return archive, fmt.Errorf("failed to look up tar content owner user %s with error %w", archive.TarUserName, err)
+		}
+		archive.TarUser = uid
+	}
+	if archive.TarGroupName != "" {
+		gid, err := lookupGroupID(rootfs, archive.TarGroupName)
+		if err != nil {
+			return archive, fmt.Errorf("failed to look up tar content owner group %s with error %w", archive.TarGroupName, err)
+		}
+		archive.TarGroup = gid
+	}
+	return archive, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+// The bundle with a rootfs containing the passwd and group files
+var mockBundleTree = map[string]string{
+	"rootfs/" + passwdPath: "root:x:0:0:root:/root:/bin/sh\n# comment\n\napp:x:1001:1002::/home/app:/bin/sh\n",
+	"rootfs/" + groupPath:  "root:x:0:\napp:x:1002:\n",
+}
+
+func Test_resolveTarOwner(t *testing.T) {
+	bundle := t.TempDir()
+	writeTree(t, bundle, mockBundleTree)
+	containerSpec := spec.Spec{Root: &spec.Root{Path: "rootfs"}}
+
+	archive, err := resolveTarOwner(Archive{TarUserName: "app", TarGroupName: "app"}, bundle, containerSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, archive.TarUser, 1001)
+	assert.Equal(t, archive.TarGroup, 1002)
+
+	archive, err = resolveTarOwner(Archive{TarUser: 2000, TarGroupName: "app"}, bundle, containerSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, archive.TarUser, 2000)
+	assert.Equal(t, archive.TarGroup, 1002)
+
+	// The absolute root path is used as it is
+	containerSpec = spec.Spec{Root: &spec.Root{Path: path.Join(bundle, "rootfs")}}
+	archive, err = resolveTarOwner(Archive{TarUserName: "root"}, "/nonexistent", containerSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, archive.TarUser, 0)
+
+	_, err = resolveTarOwner(Archive{TarUserName: "nobody-here"}, bundle, containerSpec)
+	assert.ErrorIs(t, err, errNameNotFound)
+	_, err = resolveTarOwner(Archive{TarUserName: "app"}, bundle, spec.Spec{})
+	assert.NotNil(t, err)
+	// Nothing to resolve without names
+	archive, err = resolveTarOwner(Archive{TarUser: 2000, TarGroup: 3000}, bundle, spec.Spec{})
+	assert.Nil(t, err)
+	assert.Equal(t, archive.TarUser, 2000)
+}
+
+func Test_resolveTarOwnerHostFallback(t *testing.T) {
+	bundle := t.TempDir()
+	writeTree(t, bundle, mockBundleTree)
+	containerSpec := spec.Spec{Root: &spec.Root{Path: "rootfs"}}
+	err := os.WriteFile(path.Join(bundle, "rootfs", passwdPath), []byte("app:x:1001:1002::/home/app:/bin/sh\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = resolveTarOwner(Archive{TarUserName: "root"}, bundle, containerSpec)
+	assert.ErrorIs(t, err, errNameNotFound)
+
+	defer func(fallback bool) {
+		ownerHostFallback = fallback
+	}(ownerHostFallback)
+	ownerHostFallback = true
+	archive, err := resolveTarOwner(Archive{TarUserName: "root", TarGroupName: "app"}, bundle, containerSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, archive.TarUser, 0)
+	assert.Equal(t, archive.TarGroup, 1002)
+}
+
+func Test_openInRootSymlink(t *testing.T) {
+	bundle := t.TempDir()
+	writeTree(t, bundle, mockBundleTree)
+	rootfs := path.Join(bundle, "rootfs")
+	victimDir := t.TempDir()
+	writeTree(t, victimDir, mockVictimTree)
+	err := os.Remove(path.Join(rootfs, passwdPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The absolute symlink is resolved in the rootfs instead of the host
+	err = os.Symlink(path.Join(victimDir, "cron"), path.Join(rootfs, passwdPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openInRoot(rootfs, passwdPath)
+	assert.NotNil(t, err)
+
+	writeTree(t, path.Join(rootfs, victimDir), map[string]string{"cron": "IN_ROOT"})
+	file, err := openInRoot(rootfs, passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content := make([]byte, 7)
+	_, err = file.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(content), "IN_ROOT")
+}
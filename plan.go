@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ArchivePlan is the plan of archiving an upperdir for an archive
+type ArchivePlan struct {
+	// The name of archive
+	Name string
+	// The "destination" filed of overlay mount point to get upperdir folder from
+	MountPoint string
+	// The upperdir folder resolved for the mount point
+	UpperDir string `json:",omitempty"`
+	// The archive method to use
+	Method string
+	// The destination for copying the upperdir folder to
+	ArchiveTo string
+	// The estimated size in bytes of the files in upperdir
+	EstimatedSize int64
+	// The error of resolving the upperdir or estimating the size
+	Error string `json:",omitempty"`
+}
+
+// estimateSize returns the total size of the regular files in the given folder passing the filter
+func estimateSize(dir string, filter pathFilter) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if filter.Match(relPath, entry.IsDir()) == filterExclude {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += fileInfo.Size()
+		return nil
+	})
+	return size, err
+}
+
+// planArchives resolves upperdirs of the given archives and estimates their sizes without writing anything
+func planArchives(resolvedArchives []resolvedArchive) []ArchivePlan {
+	plans := []ArchivePlan{}
+	for _, resolved := range resolvedArchives {
+		result := newArchiveResult(resolved.Archive)
+		plan := ArchivePlan{
+			Name:       result.Name,
+			MountPoint: result.MountPoint,
+			UpperDir:   resolved.UpperDir,
+			Method:     result.Method,
+			ArchiveTo:  result.ArchiveTo,
+		}
+		if resolved.Err != nil {
+			plan.Error = resolved.Err.Error()
+			plans = append(plans, plan)
+			continue
+		}
+		size, err := estimateSize(resolved.UpperDir, archivePathFilter(resolved.Archive))
+		if err != nil {
+			plan.Error = err.Error()
+		}
+		plan.EstimatedSize = size
+		plans = append(plans, plan)
+	}
+	return plans
+}
+
+// runPlan prints the archive plan of the container with the state from given input as JSON
+func runPlan(stateInput io.Reader, output io.Writer) {
+	state, containerSpec, destArchives := loadArchives(stateInput)
+	plans := planArchives(resolveUpperDirs(state.Bundle, containerSpec, destArchives))
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(plans)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newPlanCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "plan",
+		Short: "Print the archive plan as JSON for the OCI state from stdin without writing anything",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			setupLogLevel()
+			setupUpperDirDiscovery()
+			setupPolicy(cmd)
+			runPlan(os.Stdin, cmd.OutOrStdout())
+		},
+	}
+}
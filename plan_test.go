@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_estimateSize(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, map[string]string{"a.txt": "12345", "nested/b.txt": "1234567890"})
+	err := os.Symlink("a.txt", path.Join(srcDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := estimateSize(srcDir, pathFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, size, int64(15))
+}
+
+func Test_planArchives(t *testing.T) {
+	srcDir := t.TempDir()
+	err := os.WriteFile(path.Join(srcDir, "a.txt"), []byte("12345"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plans := planArchives([]resolvedArchive{
+		{
+			Archive:  Archive{Name: "data", MountPoint: "/data", ArchiveTo: "/path/to/archive.tar.gz", Method: ArchiveMethodTarGzip},
+			UpperDir: srcDir,
+		},
+		{
+			Archive: Archive{Name: "missing", MountPoint: "/missing", ArchiveTo: "/path/to/archive"},
+			Err:     errors.New("cannot find mount point /missing in the spec"),
+		},
+	})
+	assert.Equal(t, plans, []ArchivePlan{
+		{
+			Name:          "data",
+			MountPoint:    "/data",
+			UpperDir:      srcDir,
+			Method:        ArchiveMethodTarGzip,
+			ArchiveTo:     "/path/to/archive.tar.gz",
+			EstimatedSize: 5,
+		},
+		{
+			Name:       "missing",
+			MountPoint: "/missing",
+			Method:     ArchiveMethodCopy,
+			ArchiveTo:  "/path/to/archive",
+			Error:      "cannot find mount point /missing in the spec",
+		},
+	})
+}
+
+func Test_runPlan(t *testing.T) {
+	bundleDir := t.TempDir()
+	srcDir := t.TempDir()
+	outputDir := t.TempDir()
+	archiveTo := path.Join(outputDir, "archive")
+	specValue := spec.Spec{
+		Version: spec.Version,
+		Mounts: []spec.Mount{
+			{
+				Destination: "/data",
+				Source:      "/path/to/source",
+				Type:        "overlay",
+				Options:     []string{fmt.Sprintf("upperdir=%s", srcDir)},
+			},
+		},
+		Annotations: map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  archiveTo,
+		},
+	}
+	configData, err := json.Marshal(specValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(bundleDir, "config.json"), configData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateData, err := json.Marshal(spec.State{Bundle: bundleDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	runPlan(bytes.NewReader(stateData), &output)
+	var plans []ArchivePlan
+	err = json.Unmarshal(output.Bytes(), &plans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, plans, []ArchivePlan{
+		{
+			Name:       "data",
+			MountPoint: "/data",
+			UpperDir:   srcDir,
+			Method:     ArchiveMethodCopy,
+			ArchiveTo:  archiveTo,
+		},
+	})
+	_, err = os.Stat(archiveTo)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The default path to the host side policy file, everything is allowed if it doesn't exist
+const defaultConfigPath = "/etc/archive-overlay/policy.json"
+
+// PolicyOwner is the owner of a folder, the unset uid or gid matches any
+type PolicyOwner struct {
+	Uid *int `json:",omitempty"`
+	Gid *int `json:",omitempty"`
+}
+
+// PolicyMode is a permission mode written as an octal string in the policy file, such as "0750"
+type PolicyMode os.FileMode
+
+// UnmarshalJSON parses the octal string of the mode
+func (m *PolicyMode) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode %s, expected an octal string with error %w", value, err)
+	}
+	if mode > uint64(os.ModePerm) {
+		return fmt.Errorf("invalid mode %s, expected 0 to 0777", value)
+	}
+	*m = PolicyMode(mode)
+	return nil
+}
+
+// Policy restricts what the archive annotations from the containers can do on the host, the empty fields restrict
+// nothing
+type Policy struct {
+	// The folders archive-to and success paths have to be in
+	AllowedPrefixes []string `json:",omitempty"`
+	// The archive methods allowed
+	AllowedMethods []string `json:",omitempty"`
+	// The owner of the parent folders of archive-to and success paths, the nearest existing one is checked if the
+	// parent folder doesn't exist yet
+	RequiredOwner *PolicyOwner `json:",omitempty"`
+	// The owners the archive outputs are allowed to be chowned to
+	AllowedOutputOwners []PolicyOwner `json:",omitempty"`
+	// The permission bits the archive outputs are allowed to have with the output mode
+	AllowedOutputModeMask *PolicyMode `json:",omitempty"`
+}
+
+// loadPolicyFile loads the policy from the given JSON file, an empty policy is returned if the file doesn't exist
+// and it's not required
+func loadPolicyFile(configPath string, required bool) (Policy, error) {
+	var policy Policy
+	content, err := os.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return policy, nil
+	}
+	if err != nil {
+		return policy, fmt.Errorf("failed to read policy file %s with error %w", configPath, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&policy)
+	if err != nil {
+		return policy, fmt.Errorf("failed to parse policy JSON file %s with error %w", configPath, err)
+	}
+	for i, prefix := range policy.AllowedPrefixes {
+		if !filepath.IsAbs(prefix) {
+			return policy, fmt.Errorf("invalid allowed prefix %s in policy file %s, expected an absolute path", prefix, configPath)
+		}
+		policy.AllowedPrefixes[i] = filepath.Clean(prefix)
+	}
+	for _, method := range policy.AllowedMethods {
+		if !isValidMethod(method) {
+			return policy, fmt.Errorf("invalid allowed method %s in policy file %s", method, configPath)
+		}
+	}
+	return policy, nil
+}
+
+// findAllowedPrefix returns the allowed prefix the given path is in, the path must be absolute and cleaned
+func (p Policy) findAllowedPrefix(path string) (string, bool) {
+	for _, prefix := range p.AllowedPrefixes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// checkOwner checks the owner of the nearest existing parent folder of the given path against the required owner
+func (p Policy) checkOwner(path string) error {
+	if p.RequiredOwner == nil {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	var stat syscall.Stat_t
+	for {
+		err := syscall.Stat(dir, &stat)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) || dir == "/" {
+			return fmt.Errorf("failed to stat %s with error %w", dir, err)
+		}
+		dir = filepath.Dir(dir)
+	}
+	if p.RequiredOwner.Uid != nil && int(stat.Uid) != *p.RequiredOwner.Uid {
+		return fmt.Errorf("folder %s is owned by uid %d instead of %d", dir, stat.Uid, *p.RequiredOwner.Uid)
+	}
+	if p.RequiredOwner.Gid != nil && int(stat.Gid) != *p.RequiredOwner.Gid {
+		return fmt.Errorf("folder %s is owned by gid %d instead of %d", dir, stat.Gid, *p.RequiredOwner.Gid)
+	}
+	return nil
+}
+
+// CheckPath checks if the archive is allowed to write to the given path
+func (p Policy) CheckPath(path string) error {
+	path = filepath.Clean(path)
+	if len(p.AllowedPrefixes) > 0 {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("path %s is not absolute", path)
+		}
+		if _, ok := p.findAllowedPrefix(path); !ok {
+			return fmt.Errorf("path %s is not in the allowed prefixes %s", path, strings.Join(p.AllowedPrefixes, ", "))
+		}
+	}
+	return p.checkOwner(path)
+}
+
+// CheckMethod checks if the archive method is allowed
+func (p Policy) CheckMethod(method string) error {
+	if len(p.AllowedMethods) == 0 {
+		return nil
+	}
+	if method == "" {
+		method = ArchiveMethodCopy
+	}
+	for _, allowed := range p.AllowedMethods {
+		if method == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("method %s is not in the allowed methods %s", method, strings.Join(p.AllowedMethods, ", "))
+}
+
+// CheckOutputOwner checks if the archive outputs are allowed to be chowned to the given uid and gid
+func (p Policy) CheckOutputOwner(uid int, gid int) error {
+	if len(p.AllowedOutputOwners) == 0 {
+		return nil
+	}
+	for _, owner := range p.AllowedOutputOwners {
+		if (owner.Uid == nil || *owner.Uid == uid) && (owner.Gid == nil || *owner.Gid == gid) {
+			return nil
+		}
+	}
+	return fmt.Errorf("output owner %d:%d is not in the allowed output owners", uid, gid)
+}
+
+// CheckOutputMode checks if the archive outputs are allowed to have the given permission bits
+func (p Policy) CheckOutputMode(mode os.FileMode) error {
+	if p.AllowedOutputModeMask == nil {
+		return nil
+	}
+	mask := os.FileMode(*p.AllowedOutputModeMask)
+	if mode&^mask != 0 {
+		return fmt.Errorf("output mode %04o is not in the allowed output mode mask %04o", mode, mask)
+	}
+	return nil
+}
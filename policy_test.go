@@ -0,0 +1,201 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_loadPolicyFile(t *testing.T) {
+	configDir := t.TempDir()
+	configPath := path.Join(configDir, "policy.json")
+
+	policy, err := loadPolicyFile(configPath, false)
+	assert.Nil(t, err)
+	assert.Equal(t, policy, Policy{})
+	_, err = loadPolicyFile(configPath, true)
+	assert.NotNil(t, err)
+
+	err = os.WriteFile(configPath, []byte(`{
+		"AllowedPrefixes": ["/var/archives/"],
+		"AllowedMethods": ["tar.gz"],
+		"RequiredOwner": {"Uid": 1000},
+		"AllowedOutputModeMask": "0750"
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err = loadPolicyFile(configPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := 1000
+	mask := PolicyMode(0750)
+	assert.Equal(t, policy, Policy{
+		AllowedPrefixes:       []string{"/var/archives"},
+		AllowedMethods:        []string{"tar.gz"},
+		RequiredOwner:         &PolicyOwner{Uid: &uid},
+		AllowedOutputModeMask: &mask,
+	})
+
+	for _, content := range []string{
+		`{"AllowedPrefixes": ["var/archives"]}`,
+		`{"AllowedMethods": ["tar.xz"]}`,
+		`{"AllowedPrefix": ["/var/archives"]}`,
+		`{"AllowedOutputModeMask": "0999"}`,
+		`{"AllowedOutputModeMask": "01777"}`,
+		`{"AllowedOutputModeMask": 488}`,
+	} {
+		err = os.WriteFile(configPath, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadPolicyFile(configPath, false)
+		assert.NotNil(t, err, content)
+	}
+}
+
+func Test_parseArchivesPolicy(t *testing.T) {
+	policy := Policy{
+		AllowedPrefixes: []string{"/var/archives"},
+		AllowedMethods:  []string{ArchiveMethodCopy, ArchiveMethodTarGzip},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErrs    int
+	}{
+		{
+			name: "allowed",
+			annotations: map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/var/archives/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.success":     "/var/archives/data.done",
+			},
+			wantErrs: 0,
+		},
+		{
+			name: "archive-to-outside",
+			annotations: map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/etc/cron.d/data",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "archive-to-escape",
+			annotations: map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/var/archives/../../etc/cron.d/data",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "archive-to-sibling",
+			annotations: map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/var/archives-other/data",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "archive-to-relative",
+			annotations: map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "var/archives/data",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "success-outside",
+			annotations: map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/var/archives/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.success":     "/etc/passwd",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "method-not-allowed",
+			annotations: map[string]string{
+				"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/var/archives/data",
+				"com.launchplatform.oci-hooks.archive-overlay.data.method":      "tar.zst",
+			},
+			wantErrs: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archives, errs := parseArchives(tt.annotations, policy)
+			assert.Lenf(t, errs, tt.wantErrs, "parseArchives() errors = %v", errs)
+			if tt.wantErrs > 0 {
+				assert.Empty(t, archives)
+			} else {
+				assert.Contains(t, archives, "/data")
+			}
+		})
+	}
+}
+
+func Test_parseArchivesPolicyOwner(t *testing.T) {
+	outputDir := t.TempDir()
+	annotations := map[string]string{
+		"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+		"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  path.Join(outputDir, "nested", "data"),
+	}
+	uid := os.Getuid()
+	archives, errs := parseArchives(annotations, Policy{RequiredOwner: &PolicyOwner{Uid: &uid}})
+	assert.Empty(t, errs)
+	assert.Contains(t, archives, "/data")
+
+	otherUid := uid + 1
+	archives, errs = parseArchives(annotations, Policy{RequiredOwner: &PolicyOwner{Uid: &otherUid}})
+	assert.Len(t, errs, 1)
+	assert.Empty(t, archives)
+}
+
+func Test_parseArchivesPolicyOutputOwner(t *testing.T) {
+	uid, gid := 1000, 1000
+	policy := Policy{AllowedOutputOwners: []PolicyOwner{{Uid: &uid, Gid: &gid}}}
+	for owner, wantErrs := range map[string]int{
+		"1000:1000": 0,
+		"1000:0":    1,
+		"0:0":       1,
+	} {
+		archives, errs := parseArchives(map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":  "/data",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":   "/var/archives/data",
+			"com.launchplatform.oci-hooks.archive-overlay.data.output-owner": owner,
+		}, policy)
+		assert.Lenf(t, errs, wantErrs, "parseArchives() errors = %v", errs)
+		assert.Len(t, archives, 1-wantErrs, owner)
+	}
+}
+
+func Test_parseArchivesPolicyOutputMode(t *testing.T) {
+	mask := PolicyMode(0750)
+	policy := Policy{AllowedOutputModeMask: &mask}
+	for mode, wantErrs := range map[string]int{
+		"0750": 0,
+		"0700": 0,
+		"0755": 1,
+		"0777": 1,
+	} {
+		archives, errs := parseArchives(map[string]string{
+			"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+			"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/var/archives/data",
+			"com.launchplatform.oci-hooks.archive-overlay.data.output-mode": mode,
+		}, policy)
+		assert.Lenf(t, errs, wantErrs, "parseArchives() errors = %v", errs)
+		assert.Len(t, archives, 1-wantErrs, mode)
+	}
+	// Without output-mode, the default modes are not checked
+	archives, errs := parseArchives(map[string]string{
+		"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/data",
+		"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/var/archives/data",
+	}, policy)
+	assert.Empty(t, errs)
+	assert.Len(t, archives, 1)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrQuotaExceeded is returned when an archive goes over its size or file count limit
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// The size suffixes in the power of 1024
+var sizeSuffixes = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix, such as 512, 100M or 10G
+func parseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	multiplier := int64(1)
+	if value != "" {
+		suffix, ok := sizeSuffixes[strings.ToUpper(value[len(value)-1:])[0]]
+		if ok {
+			multiplier = suffix
+			value = value[:len(value)-1]
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("negative size %d", size)
+	}
+	if size > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("size %s is too large", value)
+	}
+	return size * multiplier, nil
+}
+
+// archiveQuota is the limits of an archive, zero means no limit
+type archiveQuota struct {
+	// The max total size in bytes of the regular files archived
+	MaxSize int64
+	// The max number of files archived, including folders and other non-regular files
+	MaxFiles int64
+}
+
+// minLimit returns the lower one of the given limits, zero means no limit
+func minLimit(a int64, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// archiveQuotaLimits returns the limits of the given archive capped by the host wide ones
+func archiveQuotaLimits(archive Archive) archiveQuota {
+	return archiveQuota{
+		MaxSize:  minLimit(archive.MaxSize, maxSize),
+		MaxFiles: minLimit(archive.MaxFiles, maxFiles),
+	}
+}
+
+// quotaCounter counts the files archived against the quota
+type quotaCounter struct {
+	Quota archiveQuota
+	Size  int64
+	Files int64
+}
+
+// Check returns ErrQuotaExceeded if the given stats exceed any of the limits
+func (q archiveQuota) Check(stats archiveStats) error {
+	if q.MaxFiles > 0 && stats.Files > q.MaxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrQuotaExceeded, q.MaxFiles)
+	}
+	if q.MaxSize > 0 && stats.Size > q.MaxSize {
+		return fmt.Errorf("%w: more than %d bytes", ErrQuotaExceeded, q.MaxSize)
+	}
+	return nil
+}
+
+// Add counts a file with the given size, it returns ErrQuotaExceeded once any of the limits is exceeded
+func (c *quotaCounter) Add(size int64) error {
+	c.Files++
+	c.Size += size
+	return c.Quota.Check(archiveStats{Files: c.Files, Size: c.Size})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_parseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"4K", 4 * 1024, false},
+		{"100m", 100 * 1024 * 1024, false},
+		{" 10G ", 10 * 1024 * 1024 * 1024, false},
+		{"1T", 1024 * 1024 * 1024 * 1024, false},
+		{"", 0, true},
+		{"G", 0, true},
+		{"-1", 0, true},
+		{"1.5G", 0, true},
+		{"10P", 0, true},
+		{"9000000000000T", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			size, err := parseSize(tt.value)
+			assert.Equal(t, err != nil, tt.wantErr)
+			assert.Equal(t, size, tt.want)
+		})
+	}
+}
+
+func Test_archiveQuotaLimits(t *testing.T) {
+	defer func() {
+		maxSize = 0
+		maxFiles = 0
+	}()
+	assert.Equal(t, archiveQuotaLimits(Archive{MaxSize: 100}), archiveQuota{MaxSize: 100})
+	maxSize = 50
+	maxFiles = 10
+	assert.Equal(t, archiveQuotaLimits(Archive{MaxSize: 100}), archiveQuota{MaxSize: 50, MaxFiles: 10})
+	assert.Equal(t, archiveQuotaLimits(Archive{MaxSize: 20, MaxFiles: 30}), archiveQuota{MaxSize: 20, MaxFiles: 10})
+}
+
+// The upperdir content the quota tests archive, 4 files including the root folder and 36 bytes in total
+var mockQuotaTree = map[string]string{
+	"file0.txt": "MOCK_CONTENT",
+	"file1.txt": "MOCK_CONTENT",
+	"file2.txt": "MOCK_CONTENT",
+}
+
+func Test_archiveUpperDirQuota(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockQuotaTree)
+	tests := []struct {
+		name    string
+		archive Archive
+		wantErr bool
+	}{
+		{"copy-within", Archive{MaxSize: 36, MaxFiles: 4}, false},
+		{"copy-max-size", Archive{MaxSize: 35}, true},
+		{"copy-max-files", Archive{MaxFiles: 3}, true},
+		{"tar-within", Archive{Method: ArchiveMethodTarGzip, MaxSize: 36, MaxFiles: 4}, false},
+		{"tar-max-size", Archive{Method: ArchiveMethodTarGzip, MaxSize: 35}, true},
+		{"tar-max-files", Archive{Method: ArchiveMethodTarZstd, MaxFiles: 3}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputDir := t.TempDir()
+			archive := tt.archive
+			archive.Name = "data"
+			archive.ArchiveTo = path.Join(outputDir, "archive")
+			archive.TarUser = -1
+			archive.TarGroup = -1
+			_, err := archiveUpperDir(archive, srcDir, nil, nil)
+			if !tt.wantErr {
+				assert.Nil(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrQuotaExceeded))
+			// No partial output is left behind
+			entries, err := os.ReadDir(outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+func Test_archiveUpperDirsQuotaExceeded(t *testing.T) {
+	outputDir := t.TempDir()
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, mockQuotaTree)
+	containerSpec := spec.Spec{
+		Version: spec.Version,
+		Mounts: []spec.Mount{
+			{
+				Destination: "/data",
+				Source:      "/path/to/source",
+				Type:        "overlay",
+				Options:     []string{fmt.Sprintf("upperdir=%s", srcDir)},
+			},
+		},
+	}
+	archives := map[string]Archive{
+		"/data": {
+			Name:           "data",
+			MountPoint:     "/data",
+			ArchiveTo:      path.Join(outputDir, "archive"),
+			ArchiveSuccess: path.Join(outputDir, "success"),
+			MaxFiles:       1,
+		},
+	}
+	results := archiveUpperDirs(spec.State{}, containerSpec, archives)
+	assert.Equal(t, len(results), 1)
+	assert.Equal(t, results[0].Status, ArchiveStatusQuotaExceeded)
+	assert.Contains(t, results[0].Error, ErrQuotaExceeded.Error())
+	_, err := os.Stat(path.Join(outputDir, "success"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The PAX records of GNU sparse format 1.0
+// ref: https://www.gnu.org/software/tar/manual/html_node/Sparse-Formats.html
+const (
+	paxGNUSparseMajor    = "GNU.sparse.major"
+	paxGNUSparseMinor    = "GNU.sparse.minor"
+	paxGNUSparseName     = "GNU.sparse.name"
+	paxGNUSparseRealSize = "GNU.sparse.realsize"
+)
+
+const (
+	tarBlockSize = 512
+	// The largest size, uid and gid which fit in the octal fields of an USTAR header
+	ustarMaxSize = 1<<33 - 1
+	ustarMaxID   = 1<<21 - 1
+	// The longest user and group names which fit in an USTAR header
+	ustarMaxNameLen = 32
+	// The longest names which fit in an USTAR header without the prefix field
+	ustarMaxPathLen = 100
+)
+
+// sparseSegment is a range of a sparse file which holds data, everything else in the file is a hole
+type sparseSegment struct {
+	Offset int64
+	Length int64
+}
+
+// isSparseFile returns true if the regular file takes less disk blocks than its size, so that it may have holes
+func isSparseFile(fileInfo os.FileInfo) bool {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || !fileInfo.Mode().IsRegular() {
+		return false
+	}
+	return stat.Blocks*512 < fileInfo.Size()
+}
+
+// findDataSegments returns the data segments of the file with SEEK_DATA and SEEK_HOLE, the whole file is one
+// segment if the filesystem doesn't support them
+func findDataSegments(file *os.File, size int64) ([]sparseSegment, error) {
+	fd := int(file.Fd())
+	segments := []sparseSegment{}
+	for offset := int64(0); offset < size; {
+		dataOffset, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// Nothing but a hole is left after the offset
+			break
+		}
+		if errors.Is(err, unix.EINVAL) && offset == 0 {
+			return []sparseSegment{{Offset: 0, Length: size}}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek data of %s with error %w", file.Name(), err)
+		}
+		if dataOffset >= size {
+			break
+		}
+		holeOffset, err := unix.Seek(fd, dataOffset, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek hole of %s with error %w", file.Name(), err)
+		}
+		if holeOffset > size {
+			holeOffset = size
+		}
+		segments = append(segments, sparseSegment{Offset: dataOffset, Length: holeOffset - dataOffset})
+		offset = holeOffset
+	}
+	return segments, nil
+}
+
+// dataSize returns the number of bytes in the data segments
+func dataSize(segments []sparseSegment) int64 {
+	var size int64
+	for _, segment := range segments {
+		size += segment.Length
+	}
+	return size
+}
+
+// copySegments copies the data segments of src into the same offsets of dest, and sizes dest to size so that the
+// holes are left unallocated
+func copySegments(dest *os.File, src *os.File, segments []sparseSegment, size int64) error {
+	for _, segment := range segments {
+		_, err := dest.Seek(segment.Offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(dest, io.NewSectionReader(src, segment.Offset, segment.Length), segment.Length)
+		if err != nil {
+			return fmt.Errorf("failed to copy data of %s at %d with error %w", src.Name(), segment.Offset, err)
+		}
+	}
+	return dest.Truncate(size)
+}
+
+// formatPAXRecord formats the PAX record as "%d %s=%s\n" where the size counts the whole record
+func formatPAXRecord(key string, value string) string {
+	size := len(key) + len(value) + len(" =\n")
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	if len(record) != size {
+		// The size gets one more digit by counting itself
+		record = strconv.Itoa(len(record)) + " " + key + "=" + value + "\n"
+	}
+	return record
+}
+
+// ustarName returns the ASCII name which fits in the name field of an USTAR header
+func ustarName(name string) string {
+	ascii := []byte(name)
+	for i, c := range ascii {
+		if c >= 0x80 || c == 0 {
+			ascii[i] = '_'
+		}
+	}
+	if len(ascii) > ustarMaxPathLen {
+		ascii = ascii[len(ascii)-ustarMaxPathLen:]
+	}
+	return string(ascii)
+}
+
+// padBlock returns the padding bytes to fill up the last tar block of the given size
+func padBlock(size int64) []byte {
+	return make([]byte, (tarBlockSize-size%tarBlockSize)%tarBlockSize)
+}
+
+// rawHeaderBlock returns the USTAR header block of the given header with the typeflag replaced, it lets us write
+// the headers the tar writer doesn't support
+func rawHeaderBlock(header *tar.Header, typeflag byte) ([]byte, error) {
+	var buf bytes.Buffer
+	scratch := tar.NewWriter(&buf)
+	err := scratch.WriteHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	block := buf.Bytes()[:tarBlockSize]
+	const typeflagOffset, chksumOffset, chksumLen = 156, 148, 8
+	block[typeflagOffset] = typeflag
+	// The checksum is computed with its own field filled with spaces
+	copy(block[chksumOffset:chksumOffset+chksumLen], "        ")
+	var chksum int64
+	for _, c := range block {
+		chksum += int64(c)
+	}
+	copy(block[chksumOffset:chksumOffset+chksumLen], fmt.Sprintf("%06o\x00 ", chksum))
+	return block, nil
+}
+
+// writeSparseTarEntry writes the regular file as a GNU sparse format 1.0 entry which only holds the data segments.
+// Go's tar writer doesn't write sparse files, so the PAX header, the header and the data are written to the writer
+// as raw blocks, any pending block of the tar writer has to be flushed beforehand.
+// ref: https://github.com/golang/go/blob/go1.20/src/archive/tar/writer.go#L199-L277
+func writeSparseTarEntry(writer io.Writer, header *tar.Header, file *os.File, segments []sparseSegment) error {
+	mapSegments := segments
+	if len(segments) == 0 || segments[len(segments)-1].Offset+segments[len(segments)-1].Length < header.Size {
+		// An empty segment at the end marks the trailing hole, or GNU tar truncates the file at the last data
+		mapSegments = append(append([]sparseSegment{}, segments...), sparseSegment{Offset: header.Size})
+	}
+	var sparseMap bytes.Buffer
+	sparseMap.WriteString(strconv.Itoa(len(mapSegments)) + "\n")
+	for _, segment := range mapSegments {
+		sparseMap.WriteString(strconv.FormatInt(segment.Offset, 10) + "\n")
+		sparseMap.WriteString(strconv.FormatInt(segment.Length, 10) + "\n")
+	}
+	sparseMap.Write(padBlock(int64(sparseMap.Len())))
+	size := int64(sparseMap.Len()) + dataSize(segments)
+
+	records := map[string]string{
+		paxGNUSparseMajor:    "1",
+		paxGNUSparseMinor:    "0",
+		paxGNUSparseName:     header.Name,
+		paxGNUSparseRealSize: strconv.FormatInt(header.Size, 10),
+	}
+	for key, value := range header.PAXRecords {
+		records[key] = value
+	}
+	// The fields which don't fit in the USTAR header go to the PAX header
+	mainHeader := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ustarName(path.Join(path.Dir(header.Name), "GNUSparseFile.0", path.Base(header.Name))),
+		Mode:     header.Mode,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		Size:     size,
+		ModTime:  header.ModTime.Truncate(time.Second),
+		Format:   tar.FormatUSTAR,
+	}
+	if size > ustarMaxSize {
+		records["size"] = strconv.FormatInt(size, 10)
+		mainHeader.Size = 0
+	}
+	if mainHeader.Uid > ustarMaxID {
+		records["uid"] = strconv.Itoa(mainHeader.Uid)
+		mainHeader.Uid = 0
+	}
+	if mainHeader.Gid > ustarMaxID {
+		records["gid"] = strconv.Itoa(mainHeader.Gid)
+		mainHeader.Gid = 0
+	}
+	if len(mainHeader.Uname) > ustarMaxNameLen || ustarName(mainHeader.Uname) != mainHeader.Uname {
+		records["uname"] = mainHeader.Uname
+		mainHeader.Uname = ""
+	}
+	if len(mainHeader.Gname) > ustarMaxNameLen || ustarName(mainHeader.Gname) != mainHeader.Gname {
+		records["gname"] = mainHeader.Gname
+		mainHeader.Gname = ""
+	}
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var paxData bytes.Buffer
+	for _, key := range keys {
+		paxData.WriteString(formatPAXRecord(key, records[key]))
+	}
+
+	paxBlock, err := rawHeaderBlock(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ustarName(path.Join(path.Dir(header.Name), "PaxHeaders.0", path.Base(header.Name))),
+		Mode:     0644,
+		Size:     int64(paxData.Len()),
+		ModTime:  mainHeader.ModTime,
+		Format:   tar.FormatUSTAR,
+	}, tar.TypeXHeader)
+	if err != nil {
+		return err
+	}
+	mainBlock, err := rawHeaderBlock(mainHeader, tar.TypeReg)
+	if err != nil {
+		return err
+	}
+	paxData.Write(padBlock(int64(paxData.Len())))
+	for _, data := range [][]byte{paxBlock, paxData.Bytes(), mainBlock, sparseMap.Bytes()} {
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+	for _, segment := range segments {
+		_, err := io.CopyN(writer, io.NewSectionReader(file, segment.Offset, segment.Length), segment.Length)
+		if err != nil {
+			return fmt.Errorf("failed to write data of %s at %d with error %w", file.Name(), segment.Offset, err)
+		}
+	}
+	_, err = writer.Write(padBlock(size))
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+const mockSparseSize = 4 << 20
+
+func makeSparseFile(t *testing.T, filePath string) []byte {
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = file.Truncate(mockSparseSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("MOCK_CONTENT"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSparseFile(fileInfo) {
+		t.Skip("The filesystem doesn't support sparse files")
+	}
+	content := make([]byte, mockSparseSize)
+	copy(content[1<<20:], "MOCK_CONTENT")
+	return content
+}
+
+func Test_findDataSegments(t *testing.T) {
+	srcDir := t.TempDir()
+	filePath := path.Join(srcDir, "sparse.img")
+	makeSparseFile(t, filePath)
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	segments, err := findDataSegments(file, mockSparseSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(segments), 1)
+	// The data segment covers the written bytes in the filesystem blocks
+	assert.LessOrEqual(t, segments[0].Offset, int64(1<<20))
+	assert.GreaterOrEqual(t, segments[0].Offset+segments[0].Length, int64(1<<20+len("MOCK_CONTENT")))
+	assert.Less(t, dataSize(segments), int64(mockSparseSize))
+}
+
+func Test_copyFileSparse(t *testing.T) {
+	srcDir := t.TempDir()
+	srcFile := path.Join(srcDir, "sparse.img")
+	expected := makeSparseFile(t, srcFile)
+	destFile := path.Join(srcDir, "copy.img")
+	err := copyFile(srcFile, destFile, 0644, cloneModeNever, archiveLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(destFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, bytes.Equal(content, expected))
+	fileInfo, err := os.Stat(destFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, isSparseFile(fileInfo))
+}
+
+func Test_writeTarSparse(t *testing.T) {
+	srcDir := t.TempDir()
+	expected := makeSparseFile(t, path.Join(srcDir, "sparse.img"))
+	// The entries after the sparse one are still readable
+	err := os.WriteFile(path.Join(srcDir, "z.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	entries, err := writeTar(srcDir, &buf, tarOptions{Uid: -1, Gid: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, entries, int64(3))
+	assert.Less(t, buf.Len(), mockSparseSize)
+
+	tarReader := tar.NewReader(&buf)
+	contents := map[string][]byte{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[header.Name] = content
+		if header.Name == "./sparse.img" {
+			assert.Equal(t, header.Size, int64(mockSparseSize))
+		}
+	}
+	assert.Contains(t, contents, "./sparse.img")
+	assert.True(t, bytes.Equal(contents["./sparse.img"], expected))
+	assert.Equal(t, string(contents["./z.txt"]), "MOCK_CONTENT")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// The containers/storage overlay driver directory under graph root with layer dirs in it
+	storageOverlayDir = "overlay"
+	// The containers/storage directory under graph root with container dirs in it
+	storageContainersDir = "overlay-containers"
+	// The containers/storage directory under graph root with layer metadata in it
+	storageLayersDir = "overlay-layers"
+)
+
+// The metadata files of containers and layers, the volatile ones are for the containers and layers created with
+// the --rm option or transient store, which are not fsync'ed.
+// ref: https://github.com/containers/storage/blob/v1.48.0/containers.go
+// ref: https://github.com/containers/storage/blob/v1.48.0/layers.go
+var (
+	storageContainersFiles = []string{"containers.json", "volatile-containers.json"}
+	storageLayersFiles     = []string{"layers.json", "volatile-layers.json"}
+)
+
+type storageRecord struct {
+	ID string `json:"id"`
+}
+
+// hasStorageRecord returns true if any of the given metadata files has a record with the given id
+func hasStorageRecord(dir string, files []string, id string) (bool, error) {
+	for _, file := range files {
+		content, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return false, err
+		}
+		var records []storageRecord
+		err = json.Unmarshal(content, &records)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse %s with error %w", filepath.Join(dir, file), err)
+		}
+		for _, record := range records {
+			if record.ID == id {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// storageMountOptionsFinder finds mount options for the given source from the containers/storage metadata and the
+// directory layout, it works even after the overlay is unmounted. The supported sources are
+//
+//	<graphroot>/overlay-containers/<container-id>/userdata/overlay/<n>/merge for image mounts
+//	<graphroot>/overlay/<layer-id>/merged for container rootfs
+type storageMountOptionsFinder struct{}
+
+func (f storageMountOptionsFinder) FindMountOptions(source string) ([]string, error) {
+	source = filepath.Clean(source)
+	parts := strings.Split(source, string(filepath.Separator))
+	graphRoot := func(i int) string {
+		return string(filepath.Separator) + filepath.Join(parts[:i]...)
+	}
+	for i := 1; i+2 < len(parts); i++ {
+		if parts[i] != storageContainersDir || parts[i+2] != "userdata" {
+			continue
+		}
+		containerID := parts[i+1]
+		found, err := hasStorageRecord(filepath.Join(graphRoot(i), storageContainersDir), storageContainersFiles, containerID)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("no container %s found in storage %s", containerID, graphRoot(i))
+		}
+		upperDir, err := findLayoutUpperDir(source)
+		if err != nil {
+			return nil, err
+		}
+		return []string{upperDirPrefix + upperDir}, nil
+	}
+
+	i := len(parts) - 3
+	if i < 1 || parts[i] != storageOverlayDir {
+		return nil, fmt.Errorf("source %s is not in a known containers/storage layout", source)
+	}
+	layerID := parts[i+1]
+	found, err := hasStorageRecord(filepath.Join(graphRoot(i), storageLayersDir), storageLayersFiles, layerID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no layer %s found in storage %s", layerID, graphRoot(i))
+	}
+	upperDir, err := findLayoutUpperDir(source)
+	if err != nil {
+		return nil, err
+	}
+	mountOptions := []string{upperDirPrefix + upperDir}
+	lowerDirs, err := readStorageLowerDirs(filepath.Join(graphRoot(i), storageOverlayDir), layerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(lowerDirs) > 0 {
+		mountOptions = append(mountOptions, lowerDirPrefix+strings.Join(lowerDirs, ":"))
+	}
+	return mountOptions, nil
+}
+
+// readStorageLowerDirs reads the lower dirs of the given layer from the top to the bottom, the "lower" file in the
+// layer dir has the links to lower layers relative to the overlay dir
+func readStorageLowerDirs(overlayDir string, layerID string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(overlayDir, layerID, "lower"))
+	if err != nil {
+		// The base layer has no lower file
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lowerDirs []string
+	for _, link := range strings.Split(strings.TrimSpace(string(content)), ":") {
+		if link == "" {
+			continue
+		}
+		lowerDir, err := filepath.EvalSymlinks(filepath.Join(overlayDir, link))
+		if err != nil {
+			return nil, err
+		}
+		lowerDirs = append(lowerDirs, lowerDir)
+	}
+	return lowerDirs, nil
+}
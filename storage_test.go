@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func Test_storageMountOptionsFinder(t *testing.T) {
+	graphRoot := t.TempDir()
+	mkdirs := func(dirs ...string) {
+		for _, dir := range dirs {
+			err := os.MkdirAll(path.Join(graphRoot, dir), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeFile := func(name string, content string) {
+		err := os.WriteFile(path.Join(graphRoot, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdirs(
+		"overlay-containers/container0/userdata/overlay/3190055391/upper",
+		"overlay-containers/unknown/userdata/overlay/3190055391/upper",
+		"overlay-layers",
+		"overlay/base/diff",
+		"overlay/layer0/diff",
+		"overlay/l",
+	)
+	writeFile("overlay-containers/containers.json", `[{"id": "other"}]`)
+	writeFile("overlay-containers/volatile-containers.json", `[{"id": "container0", "layer": "layer0"}]`)
+	writeFile("overlay-layers/layers.json", `[{"id": "base"}, {"id": "layer0", "parent": "base"}]`)
+	writeFile("overlay/layer0/lower", "l/BASE")
+	err := os.Symlink("../base/diff", path.Join(graphRoot, "overlay", "l", "BASE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	graphRoot, err = filepath.EvalSymlinks(graphRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder := storageMountOptionsFinder{}
+	mountOptions, err := finder.FindMountOptions(path.Join(graphRoot, "overlay-containers/container0/userdata/overlay/3190055391/merge"))
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=" + path.Join(graphRoot, "overlay-containers/container0/userdata/overlay/3190055391/upper")})
+
+	mountOptions, err = finder.FindMountOptions(path.Join(graphRoot, "overlay/layer0/merged"))
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{
+		"upperdir=" + path.Join(graphRoot, "overlay/layer0/diff"),
+		"lowerdir=" + path.Join(graphRoot, "overlay/base/diff"),
+	})
+
+	mountOptions, err = finder.FindMountOptions(path.Join(graphRoot, "overlay/base/merged"))
+	assert.NoError(t, err)
+	assert.Equal(t, mountOptions, []string{"upperdir=" + path.Join(graphRoot, "overlay/base/diff")})
+
+	for _, source := range []string{
+		path.Join(graphRoot, "overlay-containers/unknown/userdata/overlay/3190055391/merge"),
+		path.Join(graphRoot, "overlay/unknown/merged"),
+		"/path/to/merged",
+	} {
+		_, err = finder.FindMountOptions(source)
+		assert.Error(t, err, source)
+	}
+}
@@ -194,3 +194,30 @@ class TestArchive:
                     path=pathlib.PurePosixPath("./var/empty"),
                     tar_file=tar_file,
                 )
+
+    @pytest.mark.asyncio
+    async def test_archive_with_oci_layer(self):
+        archive_to = self.tmp_path / "layer.tar.gz"
+        self.image_mount.archive_to = archive_to
+        self.image_mount.archive_method = "oci-layer"
+        container = Container(
+            command=(
+                "/bin/sh",
+                "-c",
+                "rm -rf /data/var/empty && rm -rf /data/usr/bin/diff",
+            ),
+            image=self.image,
+            mounts=[self.image_mount],
+            network="none",
+        )
+        async with self.run(container) as proc:
+            assert await proc.wait() == 0
+
+        with tarfile.open(archive_to, "r:gz") as tar_file:
+            assert_has_whiteout_file(
+                path=pathlib.PurePosixPath("./usr/bin/diff"),
+                prefix=".wh.",
+                tar_file=tar_file,
+            )
+            for member in tar_file.getmembers():
+                assert member.type != tarfile.CHRTYPE
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path"
+)
+
+// loadAnnotationsFile loads annotations from a JSON file with an object mapping annotation keys to values
+func loadAnnotationsFile(annotationsPath string) (map[string]string, error) {
+	content, err := os.ReadFile(annotationsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read annotations file %s with error %w", annotationsPath, err)
+	}
+	var annotations map[string]string
+	err = json.Unmarshal(content, &annotations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse annotations JSON file %s with error %w", annotationsPath, err)
+	}
+	return annotations, nil
+}
+
+// validateAnnotations writes the problems of the archive annotations under the policy to the given writer and
+// returns the count of them
+func validateAnnotations(annotations map[string]string, policy Policy, output io.Writer) int {
+	archives, errs := parseArchives(annotations, policy)
+	for _, err := range errs {
+		fmt.Fprintf(output, "Error: %s\n", err)
+	}
+	if len(errs) == 0 {
+		fmt.Fprintf(output, "OK: %d archive(s) found\n", len(archives))
+	}
+	return len(errs)
+}
+
+func newValidateCmd() *cobra.Command {
+	var annotationsPath string
+	var bundlePath string
+	validateCmd := &cobra.Command{
+		Use:   "validate [options]",
+		Short: "Validate archive annotations without running a container",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var annotations map[string]string
+			if annotationsPath == "" && bundlePath == "" {
+				return fmt.Errorf("either --annotations or --bundle is required")
+			}
+			if annotationsPath != "" {
+				var err error
+				annotations, err = loadAnnotationsFile(annotationsPath)
+				if err != nil {
+					return err
+				}
+			} else {
+				containerSpec, err := loadSpecFile(path.Join(bundlePath, "config.json"))
+				if err != nil {
+					return err
+				}
+				annotations = containerSpec.Annotations
+			}
+			setupPolicy(cmd)
+			if validateAnnotations(annotations, archivePolicy, cmd.OutOrStdout()) > 0 {
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	flags := validateCmd.Flags()
+	flags.StringVar(
+		&annotationsPath,
+		"annotations",
+		"",
+		"The path to a JSON file with an object mapping annotation keys to values",
+	)
+	flags.StringVar(
+		&bundlePath,
+		"bundle",
+		"",
+		"The path to an OCI bundle with config.json file in it",
+	)
+	validateCmd.MarkFlagsMutuallyExclusive("annotations", "bundle")
+	return validateCmd
+}
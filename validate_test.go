@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_validateAnnotations(t *testing.T) {
+	var output bytes.Buffer
+	count := validateAnnotations(map[string]string{
+		"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+		"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":  "/path/to/archive-to",
+	}, Policy{}, &output)
+	assert.Equal(t, count, 0)
+	assert.Equal(t, output.String(), "OK: 1 archive(s) found\n")
+
+	output.Reset()
+	count = validateAnnotations(map[string]string{
+		"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+		"com.launchplatform.oci-hooks.archive-overlay.data.method":      "tar.xz",
+	}, Policy{}, &output)
+	assert.Equal(t, count, 2)
+	assert.Contains(t, output.String(), "Error: empty archive-to argument value for archive data\n")
+	assert.Contains(t, output.String(), "Error: invalid method argument value tar.xz for archive data")
+
+	output.Reset()
+	count = validateAnnotations(map[string]string{
+		"com.launchplatform.oci-hooks.archive-overlay.data.mount-point":       "/path/to/mount-point",
+		"com.launchplatform.oci-hooks.archive-overlay.data.archive-to":        "/path/to/archive-to",
+		"com.launchplatform.oci-hooks.archive-overlay.data.tar-content-owner": "app:../group",
+		"com.launchplatform.oci-hooks.archive-overlay.data.output-owner":      "app",
+	}, Policy{}, &output)
+	assert.Equal(t, count, 2)
+	assert.Contains(t, output.String(), "valid names but got \"../group\"")
+	assert.Contains(t, output.String(), "only uid and gid are supported")
+}
+
+func Test_loadAnnotationsFile(t *testing.T) {
+	tempDir := t.TempDir()
+	annotations := map[string]string{
+		"com.launchplatform.oci-hooks.archive-overlay.data.mount-point": "/path/to/mount-point",
+	}
+	content, err := json.Marshal(annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotationsPath := path.Join(tempDir, "annotations.json")
+	err = os.WriteFile(annotationsPath, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := loadAnnotationsFile(annotationsPath)
+	assert.NoError(t, err)
+	assert.Equal(t, result, annotations)
+
+	_, err = loadAnnotationsFile(path.Join(tempDir, "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+const (
+	// The prefix of OCI whiteout files, see
+	// ref: https://github.com/opencontainers/image-spec/blob/v1.0.2/layer.md#whiteouts
+	ociWhiteoutPrefix = ".wh."
+	// The name of OCI opaque whiteout file
+	ociWhiteoutOpaqueDir = ociWhiteoutPrefix + ociWhiteoutPrefix + ".opq"
+)
+
+// The xattrs overlayfs uses for marking a directory as opaque, the user namespace one is used with the
+// userxattr mount option (rootless) while the trusted one is used otherwise.
+// ref: https://docs.kernel.org/filesystems/overlayfs.html#whiteouts-and-opaque-directories
+var overlayOpaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// isWhiteoutDevice returns true if the given file is an overlayfs whiteout, i.e, a character device with
+// 0/0 device number
+func isWhiteoutDevice(fileInfo os.FileInfo) bool {
+	if fileInfo.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return stat.Rdev == 0
+}
+
+// isOpaqueDir returns true if the given directory is marked as opaque by overlayfs
+func isOpaqueDir(path string) (bool, error) {
+	for _, name := range overlayOpaqueXattrs {
+		value := make([]byte, 1)
+		size, err := unix.Lgetxattr(path, name, value)
+		if err != nil {
+			if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.ERANGE) {
+				continue
+			}
+			return false, err
+		}
+		if size == 1 && value[0] == 'y' {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+const paxSchilyXattr = "SCHILY.xattr."
+
+// The xattr namespaces used by overlayfs internally, they make no sense once whiteouts are converted
+var overlayXattrNamespaces = []string{"trusted.overlay", "user.overlay"}
+
+// listXattrs returns the names of extended attributes of the given path without following symlinks
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			if errors.Is(err, unix.ENOTSUP) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if err != nil {
+			// The list grew between the two calls, try again
+			if errors.Is(err, unix.ERANGE) {
+				continue
+			}
+			return nil, err
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// getXattr returns the value of the extended attribute of the given path without following symlinks
+func getXattr(path string, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, buf)
+		if err != nil {
+			// The value grew between the two calls, try again
+			if errors.Is(err, unix.ERANGE) {
+				continue
+			}
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
+
+// matchXattrNamespace returns true if the xattr name is in any of the given namespaces, a namespace can be a
+// top level one like "user" or a nested one like "user.mime_type"
+func matchXattrNamespace(name string, namespaces []string) bool {
+	for _, namespace := range namespaces {
+		if name == namespace || strings.HasPrefix(name, namespace+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// readXattrs reads the extended attributes of the given path filtered by include and exclude namespaces,
+// all of them are included if the include namespaces are empty
+func readXattrs(path string, include []string, exclude []string) (map[string]string, error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := map[string]string{}
+	for _, name := range names {
+		if len(include) > 0 && !matchXattrNamespace(name, include) {
+			continue
+		}
+		if matchXattrNamespace(name, exclude) {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if err != nil {
+			// The xattr was removed after we listed it
+			if errors.Is(err, unix.ENODATA) {
+				continue
+			}
+			return nil, err
+		}
+		xattrs[name] = string(value)
+	}
+	return xattrs, nil
+}
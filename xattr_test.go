@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_matchXattrNamespace(t *testing.T) {
+	assert.True(t, matchXattrNamespace("user.foo", []string{"user"}))
+	assert.True(t, matchXattrNamespace("user.foo", []string{"security", "user.foo"}))
+	assert.True(t, matchXattrNamespace("security.capability", []string{"security"}))
+	assert.False(t, matchXattrNamespace("userfoo.bar", []string{"user"}))
+	assert.False(t, matchXattrNamespace("user.foo", []string{"user.foobar"}))
+	assert.False(t, matchXattrNamespace("user.foo", nil))
+}
+
+func Test_readXattrs(t *testing.T) {
+	srcDir := t.TempDir()
+	filePath := path.Join(srcDir, "file.txt")
+	err := os.WriteFile(filePath, []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"user.foo": "FOO", "user.bar": "BAR", "user.overlay.origin": "ORIGIN"} {
+		err = unix.Lsetxattr(filePath, name, []byte(value), 0)
+		if err != nil {
+			t.Skipf("Cannot set xattr with error %s", err)
+		}
+	}
+
+	xattrs, err := readXattrs(filePath, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, xattrs, map[string]string{"user.foo": "FOO", "user.bar": "BAR", "user.overlay.origin": "ORIGIN"})
+
+	xattrs, err = readXattrs(filePath, []string{"user"}, overlayXattrNamespaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, xattrs, map[string]string{"user.foo": "FOO", "user.bar": "BAR"})
+
+	xattrs, err = readXattrs(filePath, []string{"user.foo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, xattrs, map[string]string{"user.foo": "FOO"})
+
+	xattrs, err = readXattrs(filePath, []string{"security"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, xattrs)
+}